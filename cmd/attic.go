@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	atticDirName  = "attic"
+	atticDbName   = "attic"
+	atticDbExt    = "tar.gz"
+	pkgFileMarker = ".pkg.tar"
+)
+
+// atticPolicy tells how long superseded packages are kept, zero values mean no limit.
+type atticPolicy struct {
+	maxAge      time.Duration
+	maxVersions int
+	maxSize     int64
+}
+
+type atticFile struct {
+	name    string
+	size    int64
+	entered time.Time
+}
+
+func sectionAtticDir(rootDir, arch, sectionName string) string {
+	return filepath.Join(rootDir, atticDirName, arch, sectionName)
+}
+
+// isPkgFile tells whether the file is a complete package or its signature.
+func isPkgFile(name string) bool {
+	_, ext, found := strings.Cut(strings.TrimSuffix(name, sigSuffix), pkgFileMarker)
+	return found && !strings.Contains(ext, partSuffix) && !strings.Contains(ext, stagedSuffix)
+}
+
+// pkgNameOf returns the package name from '<name>-<pkgver>-<pkgrel>-<arch>.pkg.tar.*'.
+func pkgNameOf(fileName string) string {
+	base, _, _ := strings.Cut(fileName, pkgFileMarker)
+	parts := strings.Split(base, "-")
+	if len(parts) < 4 {
+		return base
+	}
+	return strings.Join(parts[:len(parts)-3], "-")
+}
+
+// pkgVersionOf returns '<pkgver>-<pkgrel>' from '<name>-<pkgver>-<pkgrel>-<arch>.pkg.tar.*'.
+func pkgVersionOf(fileName string) string {
+	base, _, _ := strings.Cut(fileName, pkgFileMarker)
+	parts := strings.Split(base, "-")
+	if len(parts) < 4 {
+		return ""
+	}
+	return strings.Join(parts[len(parts)-3:len(parts)-1], "-")
+}
+
+// versionRanks returns the place of every package among the versions of the same name, zero is the newest.
+func versionRanks(pkgs []atticFile) map[string]int {
+	byName := make(map[string][]string)
+	for _, pkg := range pkgs {
+		name := pkgNameOf(pkg.name)
+		byName[name] = append(byName[name], pkg.name)
+	}
+	result := make(map[string]int, len(pkgs))
+	for _, fileNames := range byName {
+		sort.SliceStable(fileNames, func(i, j int) bool {
+			return vercmp(pkgVersionOf(fileNames[i]), pkgVersionOf(fileNames[j])) > 0
+		})
+		for rank, fileName := range fileNames {
+			result[fileName] = rank
+		}
+	}
+	return result
+}
+
+// moveToAttic moves the superseded file into the attic, a package and its signature are moved one by one.
+func moveToAttic(sectionDir, atticDir, name string) error {
+	if mkdirErr := os.MkdirAll(atticDir, 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	return os.Rename(filepath.Join(sectionDir, name), filepath.Join(atticDir, name))
+}
+
+func dropAtticPkg(atticDir string, pkg atticFile) {
+	defPrinter.line("%s", pkg.name)
+	for _, name := range []string{pkg.name, sigPath(pkg.name)} {
+		if rmErr := rmFile(filepath.Join(atticDir, name)); rmErr != nil {
+			defPrinter.error("Unable to remove attic file: %s.", rmErr)
+		}
+	}
+}
+
+// pruneAttic drops the packages which are too old, beyond the number of versions kept, which are ordered by version,
+// or over the total size, oldest first; signatures go together with their packages.
+// The age is counted from the time the package entered the attic, the moved packages have just entered it.
+func pruneAttic(atticDir, stateDir string, moved []string, policy *atticPolicy) error {
+	entries, lookErr := os.ReadDir(atticDir)
+	if lookErr != nil {
+		if os.IsNotExist(lookErr) {
+			return nil
+		}
+		return lookErr
+	}
+	now := time.Now()
+	known := loadAtticEntries(stateDir)
+	for _, name := range moved {
+		known.Entered[name] = now
+	}
+	atticState := atticEntries{Entered: make(map[string]time.Time, len(entries))}
+	pkgs := make([]atticFile, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !isPkgFile(name) || strings.HasSuffix(name, sigSuffix) {
+			continue
+		}
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			return infoErr
+		}
+		// Packages of older attics have no record, their age starts now.
+		entered, found := known.Entered[name]
+		if !found {
+			entered = now
+		}
+		pkgs = append(pkgs, atticFile{name: name, size: info.Size(), entered: entered})
+	}
+	// Newest first, so the size limit drops the oldest ones.
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].entered.After(pkgs[j].entered)
+	})
+
+	ranks := versionRanks(pkgs)
+	var totalSize int64
+	kept := make([]atticFile, 0, len(pkgs))
+	dropped := make([]atticFile, 0)
+	for _, pkg := range pkgs {
+		switch {
+		case policy.maxAge > 0 && now.Sub(pkg.entered) > policy.maxAge:
+			dropped = append(dropped, pkg)
+		case policy.maxVersions > 0 && ranks[pkg.name] >= policy.maxVersions:
+			dropped = append(dropped, pkg)
+		case policy.maxSize > 0 && totalSize+pkg.size > policy.maxSize:
+			dropped = append(dropped, pkg)
+		default:
+			totalSize += pkg.size
+			kept = append(kept, pkg)
+			atticState.Entered[pkg.name] = pkg.entered
+		}
+	}
+	if saveErr := saveAtticEntries(stateDir, atticState); saveErr != nil {
+		return saveErr
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	defPrinter.info("Pruning attic...")
+	for _, pkg := range dropped {
+		dropAtticPkg(atticDir, pkg)
+	}
+	defPrinter.info("Attic keeps %d package(s), %s.", len(kept), formatSize(totalSize))
+	return nil
+}
+
+// updateAtticDB lists the attic packages in its own databases, so pacman can install them from the '[attic]' repo.
+// Descriptions come from the previous attic database and from the section database which listed the packages before.
+func updateAtticDB(atticDir string, superseded []pkgDesc) error {
+	if _, statErr := os.Stat(atticDir); os.IsNotExist(statErr) {
+		return nil
+	}
+	known := make(map[string]pkgDesc)
+	filesPath := filepath.Join(atticDir, dbFileName(atticDbName, "files", atticDbExt))
+	if isFileExist(filesPath) {
+		atticPkgs, loadErr := loadDescFromDB(filesPath)
+		if loadErr != nil {
+			return loadErr
+		}
+		for _, desc := range atticPkgs {
+			known[desc.fileName] = desc
+		}
+	}
+	for _, desc := range superseded {
+		known[desc.fileName] = desc
+	}
+	pkgs := make([]pkgDesc, 0, len(known))
+	for name, desc := range known {
+		if isFileExist(filepath.Join(atticDir, name)) {
+			pkgs = append(pkgs, desc)
+		}
+	}
+	if dbErr := writeDB(filepath.Join(atticDir, dbFileName(atticDbName, "db", atticDbExt)), atticDbExt, pkgs, false); dbErr != nil {
+		return dbErr
+	}
+	if dbErr := writeDB(filesPath, atticDbExt, pkgs, true); dbErr != nil {
+		return dbErr
+	}
+	defPrinter.info("Attic database lists %d package(s).", len(pkgs))
+	return fixupSymlinks(atticDir, atticDbName, atticDbExt)
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1073741824:
+		return fmt.Sprintf("%.1f GiB", float64(size)/1073741824)
+	case size >= 1048576:
+		return fmt.Sprintf("%.1f MiB", float64(size)/1048576)
+	default:
+		return fmt.Sprintf("%.1f KiB", float64(size)/1024)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -10,12 +11,53 @@ type progressBar struct {
 	idx         uint
 	amount      uint
 	fileName    string
+	source      string
 	totalSize   float64
 	baseTime    int64
 	startTime   int64
 	startSize   float64
 	prevPercent int
 	maxLineLen  int
+	live        bool
+}
+
+// syncProgress counts packages going through verification and downloading at the same time.
+type syncProgress struct {
+	mut        sync.Mutex
+	total      int
+	checked    int
+	queued     int
+	started    int
+	downloaded int
+}
+
+func (sp *syncProgress) update(change func()) {
+	defer sp.mut.Unlock()
+	sp.mut.Lock()
+	change()
+	defPrinter.setStatus(fmt.Sprintf(
+		"Checking packages: %d/%d, downloaded: %d/%d", sp.checked, sp.total, sp.downloaded, sp.queued,
+	))
+}
+
+func (sp *syncProgress) addChecked() {
+	sp.update(func() { sp.checked++ })
+}
+
+func (sp *syncProgress) addQueued() {
+	sp.update(func() { sp.queued++ })
+}
+
+func (sp *syncProgress) addDownloaded() {
+	sp.update(func() { sp.downloaded++ })
+}
+
+// nextDownload returns the index of a starting download and the amount of downloads known so far.
+func (sp *syncProgress) nextDownload() (uint, uint) {
+	defer sp.mut.Unlock()
+	sp.mut.Lock()
+	sp.started++
+	return uint(sp.started), uint(sp.queued)
 }
 
 func divmod(x, y int64) (int64, int64) {
@@ -34,26 +76,35 @@ func humanTime(etaTime float64) string {
 	return fmt.Sprintf("%02d:%02d:%02d", hours, mins, secs)
 }
 
-func newProgressBar(idx, amount uint, fileName string, totalSize int64) *progressBar {
+// newProgressBar makes a bar which is redrawn in place if live, otherwise only its first and last lines are shown.
+func newProgressBar(idx, amount uint, fileName, source string, live bool) *progressBar {
 	return &progressBar{
 		idx:         idx,
 		amount:      amount,
 		fileName:    fileName,
-		totalSize:   float64(totalSize) / 1024.0,
-		baseTime:    time.Now().Unix(),
+		source:      source,
 		prevPercent: -1,
+		live:        live && defPrinter.isVerbose(),
 	}
 }
 
-func (pb *progressBar) begin() {
-	if !defPrinter.isVerbose() {
-		status := fmt.Sprintf("[%d/%d] %s: downloading...", pb.idx, pb.amount, pb.fileName)
+func (pb *progressBar) begin(totalSize int64) {
+	pb.totalSize = float64(totalSize) / 1024.0
+	pb.baseTime = time.Now().Unix()
+	pb.startTime = 0
+	pb.startSize = 0
+	pb.prevPercent = -1
+	if !pb.live {
+		status := fmt.Sprintf("[%d/%d] %s: downloading from %s...", pb.idx, pb.amount, pb.fileName, pb.source)
 		pb.maxLineLen = max(pb.maxLineLen, len(status))
 		defPrinter.line(status)
 	}
 }
 
 func (pb *progressBar) draw(curPos int64) {
+	if !pb.live {
+		return
+	}
 	totalSize := pb.totalSize
 	startSize := pb.startSize
 	prevPercent := pb.prevPercent
@@ -112,13 +163,13 @@ func (pb *progressBar) draw(curPos int64) {
 }
 
 func (pb *progressBar) end() {
-	status := fmt.Sprintf("[%d/%d] %s: done.", pb.idx, pb.amount, pb.fileName)
+	status := fmt.Sprintf("[%d/%d] %s: done, served by %s.", pb.idx, pb.amount, pb.fileName, pb.source)
 	fillingLen := pb.maxLineLen - len(status)
 	if fillingLen < 0 {
 		fillingLen = 0
 	}
 	prefix := ""
-	if defPrinter.isVerbose() {
+	if pb.live {
 		prefix = "\r"
 	}
 	defPrinter.line(prefix + status + strings.Repeat(" ", fillingLen))
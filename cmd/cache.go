@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const chksumCacheName = "chksums"
+
+type chksumEntry struct {
+	size   int64
+	mtime  int64
+	inode  uint64
+	chksum string
+}
+
+// chksumCache remembers checksums of verified files, a file is trusted until its metadata changes.
+type chksumCache struct {
+	mut     sync.Mutex
+	path    string
+	entries map[string]chksumEntry
+}
+
+func statEntry(path string) (chksumEntry, error) {
+	info, infoErr := os.Stat(path)
+	if infoErr != nil {
+		return chksumEntry{}, infoErr
+	}
+	entry := chksumEntry{size: info.Size(), mtime: info.ModTime().UnixNano()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.inode = stat.Ino
+	}
+	return entry, nil
+}
+
+// readCache passes the entries of the cache file to parse by the file name. A cache with another header
+// is skipped; a broken one is reported and false is returned, so the caller starts over.
+func readCache(path, kind, header string, parse func(name, values string) error) bool {
+	data, readErr := os.ReadFile(path)
+	if readErr != nil {
+		if !os.IsNotExist(readErr) {
+			defPrinter.error("Unable to read %s cache: %s.", kind, readErr)
+		}
+		return true
+	}
+	lines := strings.Split(string(data), "\n")
+	if header != "" {
+		if lines[0] != header {
+			return true
+		}
+		lines = lines[1:]
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		name, values, _ := strings.Cut(line, " ")
+		if parseErr := parse(name, values); parseErr != nil {
+			defPrinter.error("Unable to parse %s cache, starting over: %s.", kind, parseErr)
+			return false
+		}
+	}
+	return true
+}
+
+// writeCache replaces the cache file with the header and the entries of the given packages only,
+// so the cache doesn't outgrow the section.
+func writeCache(path, header string, pkgs []pkgDesc, format func(name string) (string, bool)) error {
+	var lines strings.Builder
+	if header != "" {
+		lines.WriteString(header + "\n")
+	}
+	for _, desc := range pkgs {
+		if values, found := format(desc.fileName); found {
+			lines.WriteString(desc.fileName + " " + values + "\n")
+		}
+	}
+	if mkdirErr := os.MkdirAll(filepath.Dir(path), 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	if writeErr := os.WriteFile(stagedPath(path), []byte(lines.String()), 0644); writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(stagedPath(path), path)
+}
+
+// loadChksumCache reads the cache of the section, a deep one starts empty to re-hash every file once.
+func loadChksumCache(stateDir string, deep bool) *chksumCache {
+	result := &chksumCache{
+		path:    filepath.Join(stateDir, chksumCacheName),
+		entries: make(map[string]chksumEntry),
+	}
+	if deep {
+		return result
+	}
+	isRead := readCache(result.path, "checksum", "", func(name, values string) error {
+		var entry chksumEntry
+		_, scanErr := fmt.Sscanf(values, "%d %d %d %s", &entry.size, &entry.mtime, &entry.inode, &entry.chksum)
+		result.entries[name] = entry
+		return scanErr
+	})
+	if !isRead {
+		result.entries = make(map[string]chksumEntry)
+	}
+	return result
+}
+
+// chksum returns the checksum of the file, it is calculated only if the file has changed since the last time.
+func (c *chksumCache) chksum(path string, limiter *rateLimiter, buf []byte) (string, error) {
+	entry, statErr := statEntry(path)
+	if statErr != nil {
+		return "", statErr
+	}
+	name := filepath.Base(path)
+	c.mut.Lock()
+	cached, found := c.entries[name]
+	c.mut.Unlock()
+	if found && cached.size == entry.size && cached.mtime == entry.mtime && cached.inode == entry.inode {
+		return cached.chksum, nil
+	}
+	chksum, calcErr := calcChkSum(path, limiter, buf)
+	if calcErr != nil {
+		return "", calcErr
+	}
+	entry.chksum = chksum
+	c.mut.Lock()
+	c.entries[name] = entry
+	c.mut.Unlock()
+	return chksum, nil
+}
+
+// record remembers the checksum of the file verified elsewhere.
+func (c *chksumCache) record(path, chksum string) {
+	entry, statErr := statEntry(path)
+	if statErr != nil {
+		defPrinter.error("Unable to cache checksum: %s.", statErr)
+		return
+	}
+	entry.chksum = chksum
+	defer c.mut.Unlock()
+	c.mut.Lock()
+	c.entries[filepath.Base(path)] = entry
+}
+
+// save writes entries of the given packages only.
+func (c *chksumCache) save(pkgs []pkgDesc) error {
+	defer c.mut.Unlock()
+	c.mut.Lock()
+	return writeCache(c.path, "", pkgs, func(name string) (string, bool) {
+		entry, found := c.entries[name]
+		return fmt.Sprintf("%d %d %d %s", entry.size, entry.mtime, entry.inode, entry.chksum), found
+	})
+}
+
+const sigCacheName = "sigchecks"
+
+type sigEntry struct {
+	pkg chksumEntry
+	sig chksumEntry
+}
+
+// sigCache remembers packages with good signatures, a package is trusted until it, its signature or the keys change.
+type sigCache struct {
+	mut     sync.Mutex
+	path    string
+	keysId  string
+	entries map[string]sigEntry
+}
+
+// keysId tells one set of keys from another, revoking a key changes it too.
+func keysId(keys openpgp.EntityList) string {
+	ids := make([]string, 0, len(keys))
+	for _, entity := range keys {
+		id := fmt.Sprintf("%s/%d", keyFingerprint(entity), len(entity.Revocations))
+		for _, subkey := range entity.Subkeys {
+			id += fmt.Sprintf("/%X/%d", subkey.PublicKey.Fingerprint, len(subkey.Revocations))
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(ids, "\n"))))
+}
+
+// loadSigCache reads the cache of the section, entries made with other keys are dropped and a deep one starts empty.
+func loadSigCache(stateDir string, keys openpgp.EntityList, deep bool) *sigCache {
+	result := &sigCache{
+		path:    filepath.Join(stateDir, sigCacheName),
+		keysId:  keysId(keys),
+		entries: make(map[string]sigEntry),
+	}
+	if deep {
+		return result
+	}
+	isRead := readCache(result.path, "signature", result.keysId, func(name, values string) error {
+		var entry sigEntry
+		_, scanErr := fmt.Sscanf(
+			values, "%d %d %d %d %d %d",
+			&entry.pkg.size, &entry.pkg.mtime, &entry.pkg.inode, &entry.sig.size, &entry.sig.mtime, &entry.sig.inode,
+		)
+		result.entries[name] = entry
+		return scanErr
+	})
+	if !isRead {
+		result.entries = make(map[string]sigEntry)
+	}
+	return result
+}
+
+func statSigEntry(path string) (sigEntry, error) {
+	pkg, pkgErr := statEntry(path)
+	if pkgErr != nil {
+		return sigEntry{}, pkgErr
+	}
+	sig, sigErr := statEntry(sigPath(path))
+	if sigErr != nil {
+		return sigEntry{}, sigErr
+	}
+	return sigEntry{pkg: pkg, sig: sig}, nil
+}
+
+func sameFile(one, two chksumEntry) bool {
+	return one.size == two.size && one.mtime == two.mtime && one.inode == two.inode
+}
+
+// isChecked tells whether the signature of the package was found good and neither of them has changed since.
+func (c *sigCache) isChecked(path string) bool {
+	entry, statErr := statSigEntry(path)
+	if statErr != nil {
+		return false
+	}
+	c.mut.Lock()
+	cached, found := c.entries[filepath.Base(path)]
+	c.mut.Unlock()
+	return found && sameFile(cached.pkg, entry.pkg) && sameFile(cached.sig, entry.sig)
+}
+
+// record remembers the package which signature is good.
+func (c *sigCache) record(path string) {
+	entry, statErr := statSigEntry(path)
+	if statErr != nil {
+		defPrinter.error("Unable to cache signature check: %s.", statErr)
+		return
+	}
+	defer c.mut.Unlock()
+	c.mut.Lock()
+	c.entries[filepath.Base(path)] = entry
+}
+
+// save writes entries of the given packages only, after the keys they were checked with.
+func (c *sigCache) save(pkgs []pkgDesc) error {
+	defer c.mut.Unlock()
+	c.mut.Lock()
+	return writeCache(c.path, c.keysId, pkgs, func(name string) (string, bool) {
+		entry, found := c.entries[name]
+		return fmt.Sprintf(
+			"%d %d %d %d %d %d",
+			entry.pkg.size, entry.pkg.mtime, entry.pkg.inode, entry.sig.size, entry.sig.mtime, entry.sig.inode,
+		), found
+	})
+}
@@ -1,22 +1,214 @@
 package main
 
 import (
+	"fmt"
 	"github.com/BurntSushi/toml"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const defDeletePercent = 50
+
 type netMirror struct {
-	Enabled  bool     `toml:"enabled"`
-	Uri      string   `toml:"uri"`
-	Arch     string   `toml:"arch"`
-	Sections []string `toml:"sections"`
-	Threads  uint     `toml:"threads"`
+	Enabled        bool                 `toml:"enabled"`
+	Uri            string               `toml:"uri"`
+	Uris           []string             `toml:"uris"`
+	DbUri          string               `toml:"db_uri"`
+	PkgUris        []string             `toml:"pkg_uris"`
+	Arch           string               `toml:"arch"`
+	Sections       []string             `toml:"sections"`
+	Threads        uint                 `toml:"threads"`
+	Jobs           uint                 `toml:"jobs"`
+	DbExt          *string              `toml:"db_ext"`
+	DbExts         map[string]string    `toml:"db_exts"`
+	Keyring        string               `toml:"keyring"`
+	KeyringPkg     string               `toml:"keyring_pkg"`
+	KeyringSection string               `toml:"keyring_section"`
+	MasterKeys     []string             `toml:"master_keys"`
+	DeleteLimit    string               `toml:"delete_limit"`
+	DeleteLimits   map[string]string    `toml:"delete_limits"`
+	Filters        map[string]netFilter `toml:"filters"`
+}
+
+type netFilter struct {
+	Include []string `toml:"include"`
+	Exclude []string `toml:"exclude"`
+}
+
+type netAttic struct {
+	Enabled     bool `toml:"enabled"`
+	MaxAge      uint `toml:"max_age"`
+	MaxVersions uint `toml:"max_versions"`
+	MaxSize     uint `toml:"max_size"`
+}
+
+type netSnapshots struct {
+	Enabled bool `toml:"enabled"`
+	Daily   uint `toml:"daily"`
+	Weekly  uint `toml:"weekly"`
+	Monthly uint `toml:"monthly"`
 }
 
 type netConfig struct {
-	RootDir string               `toml:"rootdir"`
-	Mirrors map[string]netMirror `toml:"mirror"`
+	RootDir        string               `toml:"rootdir"`
+	VerifyJobs     uint                 `toml:"verify_jobs"`
+	VerifyRate     uint                 `toml:"verify_rate"`
+	DowngradeShare uint                 `toml:"downgrade_share"`
+	QuarantineDir  string               `toml:"quarantine_dir"`
+	Attic          netAttic             `toml:"attic"`
+	Snapshots      netSnapshots         `toml:"snapshots"`
+	Mirrors        map[string]netMirror `toml:"mirror"`
+}
+
+// upstreams returns URI templates in the order of preference.
+func (m *netMirror) upstreams() []string {
+	result := make([]string, 0, len(m.Uris)+1)
+	if m.Uri != "" {
+		result = append(result, m.Uri)
+	}
+	return append(result, m.Uris...)
+}
+
+// dbUpstreams returns URI templates the databases are fetched from.
+func (m *netMirror) dbUpstreams() []string {
+	if m.DbUri != "" {
+		return []string{m.DbUri}
+	}
+	return m.upstreams()
+}
+
+// pkgUpstreams returns URI templates the packages are fetched from.
+func (m *netMirror) pkgUpstreams() []string {
+	if len(m.PkgUris) > 0 {
+		return m.PkgUris
+	}
+	return m.upstreams()
+}
+
+// spreadPkgs tells whether packages are spread across sources instead of using them in order.
+func (m *netMirror) spreadPkgs() bool {
+	return len(m.PkgUris) > 1
+}
+
+// dbExt returns the extension of the section databases, an empty one means plain '<section>.db' files.
+func (m *netMirror) dbExt(section string) string {
+	if ext, found := m.DbExts[section]; found {
+		return strings.Trim(ext, ".")
+	}
+	if m.DbExt != nil {
+		return strings.Trim(*m.DbExt, ".")
+	}
+	return "tar.gz"
+}
+
+// policy returns how superseded packages are kept, nil means they are removed straight away.
+// The age is set in days and the size in MiB.
+func (a *netAttic) policy() *atticPolicy {
+	if !a.Enabled {
+		return nil
+	}
+	return &atticPolicy{
+		maxAge:      time.Duration(a.MaxAge) * 24 * time.Hour,
+		maxVersions: int(a.MaxVersions),
+		maxSize:     int64(a.MaxSize) * 1048576,
+	}
+}
+
+// policy returns how long snapshots are kept, nil means they are not taken.
+func (s *netSnapshots) policy() *snapshotPolicy {
+	if !s.Enabled {
+		return nil
+	}
+	return &snapshotPolicy{daily: int(s.Daily), weekly: int(s.Weekly), monthly: int(s.Monthly)}
+}
+
+// keyringSection returns the section the keyring package comes from.
+func (m *netMirror) keyringSection() string {
+	if m.KeyringSection != "" {
+		return m.KeyringSection
+	}
+	return "core"
+}
+
+// orderedSections returns the sections with the keyring one first, so its keys are known for the rest.
+func (m *netMirror) orderedSections() []string {
+	if m.KeyringPkg == "" {
+		return m.Sections
+	}
+	result := make([]string, 0, len(m.Sections))
+	for _, section := range m.Sections {
+		if section == m.keyringSection() {
+			result = append([]string{section}, result...)
+		} else {
+			result = append(result, section)
+		}
+	}
+	return result
+}
+
+// deleteLimit caps how many files of a section a sync may remove, either in percent or in files.
+type deleteLimit struct {
+	value   uint
+	percent bool
+}
+
+func (l deleteLimit) String() string {
+	if l.percent {
+		return fmt.Sprintf("%d%%", l.value)
+	}
+	return fmt.Sprintf("%d file(s)", l.value)
+}
+
+func (l deleteLimit) isExceeded(removals, present int) bool {
+	if l.percent {
+		return uint(removals)*100 > l.value*uint(present)
+	}
+	return uint(removals) > l.value
+}
+
+func parseDeleteLimit(raw string) (deleteLimit, error) {
+	raw = strings.TrimSpace(raw)
+	value := strings.TrimSuffix(raw, "%")
+	parsed, parseErr := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if parseErr != nil {
+		return deleteLimit{}, fmt.Errorf("invalid delete limit '%s'", raw)
+	}
+	result := deleteLimit{value: uint(parsed), percent: value != raw}
+	if result.percent && result.value > 100 {
+		return deleteLimit{}, fmt.Errorf("invalid delete limit '%s'", raw)
+	}
+	return result, nil
+}
+
+// deleteLimit returns the removal limit of the section, it is 50% unless set.
+func (m *netMirror) deleteLimit(section string) (deleteLimit, error) {
+	if raw, found := m.DeleteLimits[section]; found {
+		return parseDeleteLimit(raw)
+	}
+	if m.DeleteLimit != "" {
+		return parseDeleteLimit(m.DeleteLimit)
+	}
+	return deleteLimit{value: defDeletePercent, percent: true}, nil
+}
+
+// pkgFilter returns the filter of the section packages, nil means the whole section is mirrored.
+func (m *netMirror) pkgFilter(section string) (*pkgFilter, error) {
+	rules, found := m.Filters[section]
+	if !found || (len(rules.Include) == 0 && len(rules.Exclude) == 0) {
+		return nil, nil
+	}
+	return newPkgFilter(rules.Include, rules.Exclude)
+}
+
+func urlHost(rawUrl string) string {
+	parsed, parseErr := url.Parse(rawUrl)
+	if parseErr != nil || parsed.Host == "" {
+		return rawUrl
+	}
+	return parsed.Host
 }
 
 func formatUrl(uri, arch, section string) string {
@@ -35,5 +227,11 @@ func readConfig(path string) (*netConfig, error) {
 	if decodeErr != nil {
 		return nil, decodeErr
 	}
+	for name, mirror := range cfg.Mirrors {
+		if strings.HasPrefix(mirror.Keyring, "~") {
+			mirror.Keyring = strings.Replace(mirror.Keyring, "~", homeDir, 1)
+			cfg.Mirrors[name] = mirror
+		}
+	}
 	return &cfg, nil
 }
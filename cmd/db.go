@@ -3,45 +3,188 @@ package main
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"cmp"
+	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 	"io"
 	"os"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
-const fileChunkSize = 16 * 1048576
-
-func loadPkgDesc(desc string) (pkgDesc, error) {
-	var size uint64
-	var convErr error
-	var prevLine, name, chksum string
-	for _, rawLine := range strings.Split(desc, "\n") {
-		line := strings.TrimSpace(rawLine)
-		switch prevLine {
-		case "%FILENAME%":
-			name = line
-		case "%CSIZE%":
-			size, convErr = strconv.ParseUint(line, 10, 64)
-			if convErr != nil {
-				size = 0
+const (
+	fileChunkSize = 16 * 1048576
+	maxDescSize   = 16 * 1048576
+)
+
+// parseDescFields splits the desc file into fields, every field is a '%NAME%' line followed by its values up to an empty line.
+func parseDescFields(desc string) (map[string][]string, error) {
+	fields := make(map[string][]string)
+	key := ""
+	for lineNo, rawLine := range strings.Split(desc, "\n") {
+		line := strings.TrimRight(rawLine, "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			key = ""
+		case key != "":
+			fields[key] = append(fields[key], line)
+		case len(line) > 2 && strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			key = line[1 : len(line)-1]
+			if _, found := fields[key]; found {
+				return nil, fmt.Errorf("duplicated field '%s' at line %d", line, lineNo+1)
 			}
-		case "%SHA256SUM%":
-			chksum = line
+			fields[key] = make([]string, 0, 1)
+		default:
+			return nil, fmt.Errorf("value '%s' out of field at line %d", line, lineNo+1)
 		}
-		prevLine = line
-		if name != "" && size != 0 && chksum != "" {
-			return pkgDesc{name: name, size: size, chksum: chksum}, nil
+	}
+	return fields, nil
+}
+
+func singleField(fields map[string][]string, key string) (string, error) {
+	values := fields[key]
+	switch len(values) {
+	case 0:
+		return "", nil
+	case 1:
+		return values[0], nil
+	default:
+		return "", fmt.Errorf("field '%%%s%%' has %d values, expected one", key, len(values))
+	}
+}
+
+func descFromFields(fields map[string][]string) (pkgDesc, error) {
+	result := pkgDesc{
+		groups:       fields["GROUPS"],
+		licenses:     fields["LICENSE"],
+		replaces:     fields["REPLACES"],
+		conflicts:    fields["CONFLICTS"],
+		provides:     fields["PROVIDES"],
+		depends:      fields["DEPENDS"],
+		optDepends:   fields["OPTDEPENDS"],
+		makeDepends:  fields["MAKEDEPENDS"],
+		checkDepends: fields["CHECKDEPENDS"],
+		fields:       fields,
+	}
+	strFields := []struct {
+		key   string
+		value *string
+	}{
+		{"FILENAME", &result.fileName},
+		{"NAME", &result.name},
+		{"BASE", &result.base},
+		{"VERSION", &result.version},
+		{"DESC", &result.desc},
+		{"MD5SUM", &result.md5sum},
+		{"SHA256SUM", &result.chksum},
+		{"PGPSIG", &result.pgpSig},
+		{"URL", &result.url},
+		{"ARCH", &result.arch},
+		{"PACKAGER", &result.packager},
+	}
+	for _, field := range strFields {
+		value, fieldErr := singleField(fields, field.key)
+		if fieldErr != nil {
+			return pkgDesc{}, fieldErr
 		}
+		*field.value = value
+	}
+	numFields := []struct {
+		key   string
+		value *uint64
+	}{
+		{"CSIZE", &result.size},
+		{"ISIZE", &result.instSize},
+	}
+	for _, field := range numFields {
+		value, fieldErr := singleField(fields, field.key)
+		if fieldErr != nil {
+			return pkgDesc{}, fieldErr
+		}
+		if value == "" {
+			continue
+		}
+		var convErr error
+		if *field.value, convErr = strconv.ParseUint(value, 10, 64); convErr != nil {
+			return pkgDesc{}, fmt.Errorf("invalid '%%%s%%' value: %w", field.key, convErr)
+		}
+	}
+	buildDate, fieldErr := singleField(fields, "BUILDDATE")
+	if fieldErr != nil {
+		return pkgDesc{}, fieldErr
+	}
+	if buildDate != "" {
+		var convErr error
+		if result.buildDate, convErr = strconv.ParseInt(buildDate, 10, 64); convErr != nil {
+			return pkgDesc{}, fmt.Errorf("invalid '%%BUILDDATE%%' value: %w", convErr)
+		}
+	}
+	for _, key := range []string{"FILENAME", "NAME", "VERSION", "CSIZE", "SHA256SUM"} {
+		if len(fields[key]) == 0 {
+			return pkgDesc{}, fmt.Errorf("unable find field '%%%s%%'", key)
+		}
+	}
+	return result, nil
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	bzip2Magic = []byte("BZh")
+)
+
+// openArchive detects compression of the archive by its magic bytes and returns a reader
+// of the uncompressed TAR stream and a function to release the decompressor.
+func openArchive(reader *bufio.Reader) (io.Reader, func(), error) {
+	magic, peekErr := reader.Peek(len(xzMagic))
+	if peekErr != nil && peekErr != io.EOF {
+		return nil, nil, peekErr
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzReader, gzErr := gzip.NewReader(reader)
+		if gzErr != nil {
+			return nil, nil, gzErr
+		}
+		return gzReader, func() {
+			if closeErr := gzReader.Close(); closeErr != nil {
+				defPrinter.error("Unable to close gzip reader: %s.", closeErr)
+			}
+		}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, zstdErr := zstd.NewReader(reader)
+		if zstdErr != nil {
+			return nil, nil, zstdErr
+		}
+		return zstdReader, zstdReader.Close, nil
+	case bytes.HasPrefix(magic, xzMagic):
+		xzReader, xzErr := xz.NewReader(reader)
+		if xzErr != nil {
+			return nil, nil, xzErr
+		}
+		return xzReader, func() {}, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(reader), func() {}, nil
+	default:
+		return reader, func() {}, nil
 	}
-	return pkgDesc{}, fmt.Errorf("unable find fields")
 }
 
 func loadDescFromDB(path string) ([]pkgDesc, error) {
+	return loadSomeDescFromDB(path, nil)
+}
+
+// loadSomeDescFromDB loads only the packages which file names the keep function accepts, nil keeps them all.
+// Entries of the skipped packages are not read, so the file lists of a big files database are not held in memory.
+func loadSomeDescFromDB(path string, keep func(fileName string) bool) ([]pkgDesc, error) {
 	defPrinter.info("Loading package descriptions from '%s'...", filepath.Base(path))
 
 	dbFile, openErr := os.Open(path)
@@ -54,19 +197,16 @@ func loadDescFromDB(path string) ([]pkgDesc, error) {
 		}
 	}()
 
-	gzReader, gzErr := gzip.NewReader(bufio.NewReaderSize(dbFile, fileChunkSize))
-	if gzErr != nil {
-		return nil, gzErr
+	tarReader, release, arcErr := openArchive(bufio.NewReaderSize(dbFile, fileChunkSize))
+	if arcErr != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), arcErr)
 	}
-	defer func() {
-		if closeErr := gzReader.Close(); closeErr != nil {
-			defPrinter.error("Unable to close gzip reader: %s.", closeErr)
-		}
-	}()
+	defer release()
 
-	pkgs := make([]pkgDesc, 0)
-	dbTar := tar.NewReader(gzReader)
-	content := make([]byte, 131072)
+	dirs := make([]string, 0)
+	dirFields := make(map[string]map[string][]string)
+	skipped := make(map[string]struct{})
+	dbTar := tar.NewReader(tarReader)
 
 	for {
 		header, tarErr := dbTar.Next()
@@ -83,19 +223,61 @@ func loadDescFromDB(path string) ([]pkgDesc, error) {
 			continue
 		}
 		name := header.Name
-		if filepath.Base(name) != "desc" {
+		// Older repo-add versions keep dependency fields in a separate 'depends' entry,
+		// file lists are kept in the 'files' entry of the files database.
+		entryType := filepath.Base(name)
+		if entryType != "desc" && entryType != "depends" && entryType != "files" {
+			continue
+		}
+		dir := filepath.Dir(name)
+		if _, found := skipped[dir]; found {
 			continue
 		}
-		readSize, readErr := dbTar.Read(content)
-		if readErr != nil && readErr != io.EOF {
-			return nil, fmt.Errorf("desc file '%s' is too big", name)
+		if header.Size > maxDescSize {
+			return nil, fmt.Errorf("%s: entry of %d bytes is too big", name, header.Size)
+		}
+		content, readErr := io.ReadAll(dbTar)
+		if readErr != nil {
+			return nil, fmt.Errorf("%s: %w", name, readErr)
+		}
+		if len(content) == 0 {
+			// Older repo-add versions create the 'depends' entry even if the package has no dependencies.
+			if entryType != "desc" {
+				continue
+			}
+			return nil, fmt.Errorf("%s: empty entry", name)
+		}
+		fields, parseErr := parseDescFields(string(content))
+		if parseErr != nil {
+			return nil, fmt.Errorf("%s: %w", name, parseErr)
+		}
+		known, found := dirFields[dir]
+		if !found {
+			dirs = append(dirs, dir)
+			dirFields[dir] = fields
+			known = fields
+		} else {
+			for key, values := range fields {
+				if _, dup := known[key]; dup {
+					return nil, fmt.Errorf("%s: field '%%%s%%' is already set for the package", name, key)
+				}
+				known[key] = values
+			}
+		}
+		if fileNames := known["FILENAME"]; keep != nil && len(fileNames) == 1 && !keep(fileNames[0]) {
+			delete(dirFields, dir)
+			skipped[dir] = struct{}{}
 		}
-		if readSize == 0 {
-			return nil, fmt.Errorf("zero bytes read from 'desc' file '%s'", name)
+	}
+
+	pkgs := make([]pkgDesc, 0, len(dirs))
+	for _, dir := range dirs {
+		if _, found := skipped[dir]; found {
+			continue
 		}
-		pd, loadErr := loadPkgDesc(string(content))
+		pd, loadErr := descFromFields(dirFields[dir])
 		if loadErr != nil {
-			return nil, fmt.Errorf("%s: %w", name, loadErr)
+			return nil, fmt.Errorf("%s: %w", dir, loadErr)
 		}
 		pkgs = append(pkgs, pd)
 	}
@@ -103,3 +285,144 @@ func loadDescFromDB(path string) ([]pkgDesc, error) {
 	slices.SortFunc(pkgs, func(one, two pkgDesc) int { return cmp.Compare(two.size, one.size) })
 	return pkgs, nil
 }
+
+// descFieldOrder is the order repo-add writes the fields in, unknown fields follow them sorted.
+var descFieldOrder = []string{
+	"FILENAME", "NAME", "BASE", "VERSION", "DESC", "GROUPS", "CSIZE", "ISIZE", "MD5SUM", "SHA256SUM", "PGPSIG",
+	"URL", "LICENSE", "ARCH", "BUILDDATE", "PACKAGER", "REPLACES", "CONFLICTS", "PROVIDES",
+	"DEPENDS", "OPTDEPENDS", "MAKEDEPENDS", "CHECKDEPENDS",
+}
+
+func formatDesc(fields map[string][]string, keys []string) []byte {
+	var result bytes.Buffer
+	for _, key := range keys {
+		values, found := fields[key]
+		if !found {
+			continue
+		}
+		result.WriteString("%" + key + "%\n")
+		for _, value := range values {
+			result.WriteString(value + "\n")
+		}
+		result.WriteString("\n")
+	}
+	return result.Bytes()
+}
+
+func descKeys(fields map[string][]string) []string {
+	result := make([]string, 0, len(fields))
+	for _, key := range descFieldOrder {
+		if _, found := fields[key]; found {
+			result = append(result, key)
+		}
+	}
+	extra := make([]string, 0)
+	for key := range fields {
+		if key != "FILES" && !slices.Contains(descFieldOrder, key) {
+			extra = append(extra, key)
+		}
+	}
+	slices.Sort(extra)
+	return append(result, extra...)
+}
+
+func writeTarEntry(dbTar *tar.Writer, name string, content []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(content)),
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+	if headerErr := dbTar.WriteHeader(header); headerErr != nil {
+		return headerErr
+	}
+	_, writeErr := dbTar.Write(content)
+	return writeErr
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// dbCompressors make writers compressing databases by their extension, the plain databases are not compressed.
+var dbCompressors = map[string]func(io.Writer) (io.WriteCloser, error){
+	"": func(writer io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{writer}, nil
+	},
+	"tar": func(writer io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{writer}, nil
+	},
+	"tar.gz": func(writer io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(writer), nil
+	},
+	"tar.zst": func(writer io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(writer)
+	},
+	"tar.xz": func(writer io.Writer) (io.WriteCloser, error) {
+		return xz.NewWriter(writer)
+	},
+}
+
+// writeDB writes the database of the packages in the repo-add layout compressed as its extension tells,
+// the files database also gets the file lists of the packages if they are known.
+func writeDB(path, ext string, pkgs []pkgDesc, withFiles bool) error {
+	newCompressor, found := dbCompressors[ext]
+	if !found {
+		return fmt.Errorf("unable to write database '%s', '%s' compression is not supported", filepath.Base(path), ext)
+	}
+	sorted := slices.Clone(pkgs)
+	slices.SortFunc(sorted, func(one, two pkgDesc) int {
+		if byName := cmp.Compare(one.name, two.name); byName != 0 {
+			return byName
+		}
+		return cmp.Compare(one.fileName, two.fileName)
+	})
+	dbFile, openErr := os.Create(stagedPath(path))
+	if openErr != nil {
+		return openErr
+	}
+	compressor, compressErr := newCompressor(dbFile)
+	if compressErr != nil {
+		if closeErr := dbFile.Close(); closeErr != nil {
+			defPrinter.error("Unable to close '%s': %s.", stagedPath(path), closeErr)
+		}
+		return compressErr
+	}
+	dbTar := tar.NewWriter(compressor)
+	writeErr := func() error {
+		now := time.Now()
+		for _, desc := range sorted {
+			dir := fmt.Sprintf("%s-%s", desc.name, desc.version)
+			dirHeader := &tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: now}
+			if headerErr := dbTar.WriteHeader(dirHeader); headerErr != nil {
+				return headerErr
+			}
+			descErr := writeTarEntry(dbTar, dir+"/desc", formatDesc(desc.fields, descKeys(desc.fields)), now)
+			if descErr != nil {
+				return descErr
+			}
+			if _, found := desc.fields["FILES"]; !withFiles || !found {
+				continue
+			}
+			filesErr := writeTarEntry(dbTar, dir+"/files", formatDesc(desc.fields, []string{"FILES"}), now)
+			if filesErr != nil {
+				return filesErr
+			}
+		}
+		return nil
+	}()
+	for _, closer := range []io.Closer{dbTar, compressor, dbFile} {
+		if closeErr := closer.Close(); writeErr == nil {
+			writeErr = closeErr
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(stagedPath(path), path)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+type tarEntry struct {
+	name    string
+	content string
+}
+
+func writeTestDB(t *testing.T, entries []tarEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db.tar.gz")
+	dbFile, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	gzWriter := gzip.NewWriter(dbFile)
+	dbTar := tar.NewWriter(gzWriter)
+	for _, entry := range entries {
+		if writeErr := writeTarEntry(dbTar, entry.name, []byte(entry.content), time.Now()); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+	for _, closer := range []interface{ Close() error }{dbTar, gzWriter, dbFile} {
+		if closeErr := closer.Close(); closeErr != nil {
+			t.Fatal(closeErr)
+		}
+	}
+	return path
+}
+
+const testDesc = "%FILENAME%\nfoo-1.0-1-x86_64.pkg.tar.zst\n\n%NAME%\nfoo\n\n%VERSION%\n1.0-1\n\n" +
+	"%CSIZE%\n1024\n\n%SHA256SUM%\n0123456789abcdef\n\n"
+
+func TestLoadDescFromDBLegacyDepends(t *testing.T) {
+	path := writeTestDB(t, []tarEntry{
+		{"foo-1.0-1/desc", testDesc},
+		{"foo-1.0-1/depends", ""},
+		{"bar-2.0-1/desc", "%FILENAME%\nbar-2.0-1-x86_64.pkg.tar.zst\n\n%NAME%\nbar\n\n%VERSION%\n2.0-1\n\n" +
+			"%CSIZE%\n2048\n\n%SHA256SUM%\nfedcba9876543210\n\n"},
+		{"bar-2.0-1/depends", "%DEPENDS%\nfoo>=1.0\nglibc\n\n%OPTDEPENDS%\npython: for scripts\n\n"},
+	})
+	pkgs, loadErr := loadDescFromDB(path)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if len(pkgs) != 2 {
+		t.Fatalf("loaded %d packages, want 2", len(pkgs))
+	}
+	for _, desc := range pkgs {
+		switch desc.name {
+		case "foo":
+			if len(desc.depends) != 0 {
+				t.Errorf("foo depends on %q, want nothing", desc.depends)
+			}
+		case "bar":
+			if !slices.Equal(desc.depends, []string{"foo>=1.0", "glibc"}) {
+				t.Errorf("bar depends on %q", desc.depends)
+			}
+			if !slices.Equal(desc.optDepends, []string{"python: for scripts"}) {
+				t.Errorf("bar optionally depends on %q", desc.optDepends)
+			}
+		default:
+			t.Errorf("unexpected package '%s'", desc.name)
+		}
+	}
+}
+
+func TestLoadDescFromDBEmptyEntries(t *testing.T) {
+	// An empty 'depends' may come before the 'desc' entry of the package.
+	path := writeTestDB(t, []tarEntry{
+		{"foo-1.0-1/depends", ""},
+		{"foo-1.0-1/files", ""},
+		{"foo-1.0-1/desc", testDesc},
+	})
+	pkgs, loadErr := loadDescFromDB(path)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if len(pkgs) != 1 || pkgs[0].name != "foo" || pkgs[0].size != 1024 {
+		t.Fatalf("loaded %+v", pkgs)
+	}
+
+	path = writeTestDB(t, []tarEntry{{"foo-1.0-1/desc", ""}})
+	if _, loadErr = loadDescFromDB(path); loadErr == nil {
+		t.Fatal("empty desc entry is accepted")
+	}
+}
+
+func TestLoadSomeDescFromDB(t *testing.T) {
+	path := writeTestDB(t, []tarEntry{
+		{"foo-1.0-1/desc", testDesc},
+		{"foo-1.0-1/files", "%FILES%\nusr/\nusr/bin/foo\n\n"},
+		// The file list may come before the desc entry.
+		{"bar-2.0-1/files", "%FILES%\nusr/\nusr/bin/bar\n\n"},
+		{"bar-2.0-1/desc", "%FILENAME%\nbar-2.0-1-x86_64.pkg.tar.zst\n\n%NAME%\nbar\n\n%VERSION%\n2.0-1\n\n" +
+			"%CSIZE%\n2048\n\n%SHA256SUM%\nfedcba9876543210\n\n"},
+	})
+	for _, wanted := range []string{"foo-1.0-1-x86_64.pkg.tar.zst", "bar-2.0-1-x86_64.pkg.tar.zst"} {
+		pkgs, loadErr := loadSomeDescFromDB(path, func(fileName string) bool { return fileName == wanted })
+		if loadErr != nil {
+			t.Fatal(loadErr)
+		}
+		if len(pkgs) != 1 || pkgs[0].fileName != wanted {
+			t.Fatalf("loaded %+v, want only '%s'", pkgs, wanted)
+		}
+		if len(pkgs[0].fields["FILES"]) != 2 {
+			t.Errorf("'%s' has files %q", wanted, pkgs[0].fields["FILES"])
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type pkgChange struct {
+	Name       string `json:"name"`
+	OldVersion string `json:"old_version,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+	OldSize    uint64 `json:"old_size,omitempty"`
+	NewSize    uint64 `json:"new_size,omitempty"`
+}
+
+type repoDiff struct {
+	Added      []pkgChange `json:"added"`
+	Removed    []pkgChange `json:"removed"`
+	Upgraded   []pkgChange `json:"upgraded"`
+	Downgraded []pkgChange `json:"downgraded"`
+	// DownloadSize is what it takes to fetch the new state having the old one.
+	DownloadSize uint64 `json:"download_size"`
+}
+
+// loadDiffSource loads the DB from the path or from the URL, a remote DB is fetched into the temporary directory.
+func loadDiffSource(source, tmpDir string) ([]pkgDesc, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return loadDescFromDB(source)
+	}
+	name := source[strings.LastIndex(source, "/")+1:]
+	srcDir, tmpErr := os.MkdirTemp(tmpDir, "")
+	if tmpErr != nil {
+		return nil, tmpErr
+	}
+	path := filepath.Join(srcDir, name)
+	pb := newProgressBar(1, 1, name, urlHost(source), true)
+	if downErr := downloadFile(source, path, "", 1, pb); downErr != nil {
+		return nil, fmt.Errorf("unable to fetch '%s': %w", source, downErr)
+	}
+	return loadDescFromDB(path)
+}
+
+func diffPkgs(oldPkgs, newPkgs []pkgDesc) *repoDiff {
+	result := &repoDiff{
+		Added:      make([]pkgChange, 0),
+		Removed:    make([]pkgChange, 0),
+		Upgraded:   make([]pkgChange, 0),
+		Downgraded: make([]pkgChange, 0),
+	}
+	oldByName := make(map[string]pkgDesc, len(oldPkgs))
+	for _, desc := range oldPkgs {
+		oldByName[desc.name] = desc
+	}
+	newNames := make(map[string]struct{}, len(newPkgs))
+	for _, desc := range newPkgs {
+		newNames[desc.name] = struct{}{}
+		oldDesc, found := oldByName[desc.name]
+		change := pkgChange{Name: desc.name, NewVersion: desc.version, NewSize: desc.size}
+		if !found {
+			result.Added = append(result.Added, change)
+			result.DownloadSize += desc.size
+			continue
+		}
+		change.OldVersion, change.OldSize = oldDesc.version, oldDesc.size
+		switch order := vercmp(desc.version, oldDesc.version); {
+		case order == 0:
+			continue
+		case order < 0:
+			result.Downgraded = append(result.Downgraded, change)
+		default:
+			result.Upgraded = append(result.Upgraded, change)
+		}
+		result.DownloadSize += desc.size
+	}
+	for _, desc := range oldPkgs {
+		if _, found := newNames[desc.name]; !found {
+			result.Removed = append(result.Removed, pkgChange{Name: desc.name, OldVersion: desc.version, OldSize: desc.size})
+		}
+	}
+	for _, changes := range [][]pkgChange{result.Added, result.Removed, result.Upgraded, result.Downgraded} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+	return result
+}
+
+func printDiffTable(diff *repoDiff) error {
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	groups := []struct {
+		title   string
+		changes []pkgChange
+	}{
+		{"Added", diff.Added},
+		{"Removed", diff.Removed},
+		{"Upgraded", diff.Upgraded},
+		{"Downgraded", diff.Downgraded},
+	}
+	for _, group := range groups {
+		if len(group.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(table, "%s (%d):\n", group.title, len(group.changes))
+		for _, change := range group.changes {
+			switch {
+			case change.OldVersion == "":
+				fmt.Fprintf(table, "  %s\t\t%s\t%s\n", change.Name, change.NewVersion, formatSize(int64(change.NewSize)))
+			case change.NewVersion == "":
+				fmt.Fprintf(table, "  %s\t%s\t\t%s\n", change.Name, change.OldVersion, formatSize(int64(change.OldSize)))
+			default:
+				fmt.Fprintf(
+					table, "  %s\t%s\t%s\t%s -> %s\n", change.Name, change.OldVersion, change.NewVersion,
+					formatSize(int64(change.OldSize)), formatSize(int64(change.NewSize)),
+				)
+			}
+		}
+	}
+	fmt.Fprintf(
+		table, "Total: %d added, %d removed, %d upgraded, %d downgraded, %s to download.\n",
+		len(diff.Added), len(diff.Removed), len(diff.Upgraded), len(diff.Downgraded), formatSize(int64(diff.DownloadSize)),
+	)
+	return table.Flush()
+}
+
+// diffRepos compares two DBs, each one is either a local file or a URL.
+func diffRepos(oldSource, newSource string, asJson bool) error {
+	tmpDir, tmpErr := os.MkdirTemp("", "amt-diff-")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(tmpDir); rmErr != nil {
+			defPrinter.error("Unable to remove '%s': %s.", tmpDir, rmErr)
+		}
+	}()
+	oldPkgs, oldErr := loadDiffSource(oldSource, tmpDir)
+	if oldErr != nil {
+		return oldErr
+	}
+	newPkgs, newErr := loadDiffSource(newSource, tmpDir)
+	if newErr != nil {
+		return newErr
+	}
+	diff := diffPkgs(oldPkgs, newPkgs)
+	if !asJson {
+		return printDiffTable(diff)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(diff)
+}
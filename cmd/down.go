@@ -1,22 +1,144 @@
 package main
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 )
 
 const (
-	netChunkSize    = 65536
-	minThreadedSize = 10485760
-	rangeUnits      = "bytes"
-	userAgent       = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+	netChunkSize      = 65536
+	minThreadedSize   = 10485760
+	stateSaveInterval = 2 * time.Second
+	rangeUnits        = "bytes"
+	userAgent         = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
 )
 
-func downPart(ek *errKeeper, url string, fp *os.File, start, end int64, report chan<- int64) {
+type upstream struct {
+	baseUrl string
+	mut     sync.Mutex
+	served  uint
+}
+
+// newUpstreams makes upstreams for the URIs taking the known ones where they match,
+// so every upstream is counted once however many roles it plays.
+func newUpstreams(uris []string, arch, sectionName string, known []*upstream) []*upstream {
+	result := make([]*upstream, 0, len(uris))
+	for _, uri := range uris {
+		baseUrl := formatUrl(uri, arch, sectionName)
+		sameUrl := func(up *upstream) bool { return up.baseUrl == baseUrl }
+		if slices.ContainsFunc(result, sameUrl) {
+			continue
+		}
+		if idx := slices.IndexFunc(known, sameUrl); idx != -1 {
+			result = append(result, known[idx])
+		} else {
+			result = append(result, &upstream{baseUrl: baseUrl})
+		}
+	}
+	return result
+}
+
+func (u *upstream) countServed(amount uint) {
+	defer u.mut.Unlock()
+	u.mut.Lock()
+	u.served += amount
+}
+
+func (u *upstream) fileUrl(name string) string {
+	return fmt.Sprintf("%s/%s", u.baseUrl, name)
+}
+
+// probeFile asks upstreams in order whether the file has changed since the validator was taken.
+// It returns the first upstream that answered along with the validator of its copy.
+func probeFile(ups []*upstream, name string, known dbValidator) (*upstream, dbValidator, bool) {
+	for _, up := range ups {
+		url := up.fileUrl(name)
+		request, reqErr := http.NewRequest("HEAD", url, nil)
+		if reqErr != nil {
+			defPrinter.error("Unable to probe '%s': %s.", url, reqErr)
+			continue
+		}
+		request.Header.Set("User-Agent", userAgent)
+		sameUrl := known.Url == url
+		if sameUrl && known.ETag != "" {
+			request.Header.Set("If-None-Match", known.ETag)
+		}
+		if sameUrl && known.LastModified != "" {
+			request.Header.Set("If-Modified-Since", known.LastModified)
+		}
+
+		client := http.Client{}
+		respose, respErr := client.Do(request)
+		if respErr != nil {
+			defPrinter.error("Unable to probe '%s': %s.", url, respErr)
+			continue
+		}
+		if closeErr := respose.Body.Close(); closeErr != nil {
+			defPrinter.error("Unable to close response body: %s.", closeErr)
+		}
+		switch respose.StatusCode {
+		case http.StatusNotModified:
+			return up, known, sameUrl
+		case http.StatusOK:
+			validator := dbValidator{
+				Url:          url,
+				ETag:         respose.Header.Get("ETag"),
+				LastModified: respose.Header.Get("Last-Modified"),
+			}
+			// Some servers ignore conditions in HEAD requests, so compare validators by hand.
+			unchanged := sameUrl && (validator.ETag != "" || validator.LastModified != "") &&
+				validator.ETag == known.ETag && validator.LastModified == known.LastModified
+			return up, validator, unchanged
+		default:
+			defPrinter.error("Unable to probe '%s': server answered with '%s'.", url, respose.Status)
+		}
+	}
+	return nil, dbValidator{}, false
+}
+
+var errNotFound = errors.New("not found")
+
+func statusError(respose *http.Response) error {
+	if respose.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w at '%s'", errNotFound, respose.Request.URL)
+	}
+	return fmt.Errorf("server answered with '%s'", respose.Status)
+}
+
+func checkContentRange(respose *http.Response, start, end, totalSize int64) (int64, error) {
+	if respose.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("range request answered with '%s'", respose.Status)
+	}
+	var gotStart, gotEnd, gotTotal int64
+	value := respose.Header.Get("Content-Range")
+	_, scanErr := fmt.Sscanf(value, rangeUnits+" %d-%d/%d", &gotStart, &gotEnd, &gotTotal)
+	if scanErr != nil {
+		return 0, fmt.Errorf("invalid Content-Range '%s': %w", value, scanErr)
+	}
+	if end == -1 {
+		end = gotTotal
+	}
+	if gotStart != start || gotEnd != end-1 || (totalSize != -1 && gotTotal != totalSize) {
+		return 0, fmt.Errorf("Content-Range '%s' does not match requested %d-%d", value, start, end-1)
+	}
+	return gotTotal, nil
+}
+
+// segReport tells how far the segment has advanced.
+type segReport struct {
+	idx  int
+	size int64
+}
+
+func downPart(ek *errKeeper, url string, fp *os.File, idx int, seg segment, report chan<- segReport) {
 	defer ek.done()
 
 	request, reqErr := http.NewRequest("GET", url, nil)
@@ -24,13 +146,7 @@ func downPart(ek *errKeeper, url string, fp *os.File, start, end int64, report c
 		ek.set(reqErr)
 		return
 	}
-	var rangeVal string
-	if end == -1 {
-		rangeVal = fmt.Sprintf("%s=%d-", rangeUnits, start)
-	} else {
-		rangeVal = fmt.Sprintf("%s=%d-%d", rangeUnits, start, end-1)
-	}
-	request.Header.Set("Range", rangeVal)
+	request.Header.Set("Range", fmt.Sprintf("%s=%d-%d", rangeUnits, seg.done, seg.end-1))
 	request.Header.Set("User-Agent", userAgent)
 
 	client := http.Client{}
@@ -44,10 +160,13 @@ func downPart(ek *errKeeper, url string, fp *os.File, start, end int64, report c
 			defPrinter.error("Unable to close response body: %s.", closeErr)
 		}
 	}()
+	if _, rangeErr := checkContentRange(respose, seg.done, seg.end, -1); rangeErr != nil {
+		ek.set(rangeErr)
+		return
+	}
 
 	buf := make([]byte, netChunkSize)
-	off := start
-	for {
+	for seg.done < seg.end {
 		readSize, readErr := respose.Body.Read(buf)
 		if readErr != nil && readErr != io.EOF {
 			ek.set(readErr)
@@ -56,7 +175,10 @@ func downPart(ek *errKeeper, url string, fp *os.File, start, end int64, report c
 		if readSize == 0 {
 			break
 		}
-		writeSize, writeError := fp.WriteAt(buf[:readSize], off)
+		if int64(readSize) > seg.end-seg.done {
+			readSize = int(seg.end - seg.done)
+		}
+		writeSize, writeError := fp.WriteAt(buf[:readSize], seg.done)
 		if writeError != nil {
 			ek.set(writeError)
 			return
@@ -65,22 +187,41 @@ func downPart(ek *errKeeper, url string, fp *os.File, start, end int64, report c
 			ek.set(fmt.Errorf("read/write size mismatch: %d/%d", readSize, writeSize))
 			return
 		}
-		off += int64(writeSize)
-		report <- int64(readSize)
+		seg.done += int64(writeSize)
+		report <- segReport{idx: idx, size: int64(readSize)}
+	}
+	if seg.done != seg.end {
+		ek.set(fmt.Errorf("connection closed at %d of %d-%d", seg.done, seg.start, seg.end-1))
 	}
 }
 
-func getSingle(url, path string, idx, amount uint) error {
+// getSingle fetches the file in one stream and returns the checksum of the part calculated on the fly.
+func getSingle(url, path string, pb *progressBar) (string, error) {
+	part := partPath(path)
+	// A sparse part left by a threaded download can't be continued sequentially.
+	if isFileExist(statePath(path)) {
+		if dropErr := dropPart(path); dropErr != nil {
+			return "", dropErr
+		}
+	}
+	offset, sizeErr := fileSize(part)
+	if sizeErr != nil {
+		return "", sizeErr
+	}
+
 	request, reqErr := http.NewRequest("GET", url, nil)
 	if reqErr != nil {
-		return reqErr
+		return "", reqErr
 	}
 	request.Header.Set("User-Agent", userAgent)
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("%s=%d-", rangeUnits, offset))
+	}
 
 	client := http.Client{}
 	respose, respErr := client.Do(request)
 	if respErr != nil {
-		return respErr
+		return "", respErr
 	}
 	defer func() {
 		if closeErr := respose.Body.Close(); closeErr != nil {
@@ -88,9 +229,31 @@ func getSingle(url, path string, idx, amount uint) error {
 		}
 	}()
 
-	fp, openErr := os.Create(path)
+	var totalSize int64
+	openFlags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case respose.StatusCode == http.StatusOK:
+		offset = 0
+		totalSize = respose.ContentLength
+		openFlags |= os.O_TRUNC
+	case offset > 0 && respose.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return calcChkSum(part, nil, nil) // Nothing left to fetch, the checksum decides whether the part is good.
+	case offset > 0:
+		var rangeErr error
+		if totalSize, rangeErr = checkContentRange(respose, offset, -1, -1); rangeErr != nil {
+			return "", rangeErr
+		}
+		openFlags |= os.O_APPEND
+	default:
+		return "", statusError(respose)
+	}
+	if totalSize < 1 {
+		return "", fmt.Errorf("download too small")
+	}
+
+	fp, openErr := os.OpenFile(part, openFlags, 0644)
 	if openErr != nil {
-		return openErr
+		return "", openErr
 	}
 	defer func() {
 		if closeErr := fp.Close(); closeErr != nil {
@@ -98,67 +261,103 @@ func getSingle(url, path string, idx, amount uint) error {
 		}
 	}()
 
-	totalSize := respose.ContentLength
-	if totalSize < 1 {
-		return fmt.Errorf("download too small")
+	hasher := sha256.New()
+	if offset > 0 {
+		if _, hashErr := hashFile(hasher, part, nil, nil); hashErr != nil {
+			return "", hashErr
+		}
 	}
 
 	buf := make([]byte, netChunkSize)
-	pb := newProgressBar(idx, amount, filepath.Base(path), totalSize)
-	pb.begin()
-	curSize := int64(0)
+	pb.begin(totalSize)
+	curSize := offset
 	for {
 		readSize, readErr := respose.Body.Read(buf)
 		if readErr != nil && readErr != io.EOF {
-			return readErr
+			return "", readErr
 		}
 		if readSize == 0 {
 			break
 		}
 		writeSize, writeError := fp.Write(buf[:readSize])
 		if writeError != nil {
-			return writeError
+			return "", writeError
 		}
 		if writeSize != readSize {
-			return fmt.Errorf("read/write size mismatch: %d/%d", readSize, writeSize)
+			return "", fmt.Errorf("read/write size mismatch: %d/%d", readSize, writeSize)
 		}
+		hasher.Write(buf[:readSize])
 		curSize += int64(writeSize)
 		pb.draw(curSize)
 	}
 	pb.end()
-	return nil
+	if curSize != totalSize {
+		return "", fmt.Errorf("connection closed at %d of %d", curSize, totalSize)
+	}
+	if syncErr := fp.Sync(); syncErr != nil {
+		return "", syncErr
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 }
 
-func getThreaded(url, path string, threads, idx, amount uint) error {
+// getThreaded fetches ranges of the file at once and returns the checksum of the part.
+func getThreaded(url, path string, threads uint, pb *progressBar) (string, error) {
 	request, reqErr := http.NewRequest("HEAD", url, nil)
 	if reqErr != nil {
-		return reqErr
+		return "", reqErr
 	}
 	request.Header.Add("User-Agent", userAgent)
 
 	client := http.Client{}
 	respose, respErr := client.Do(request)
 	if respErr != nil {
-		return respErr
+		return "", respErr
 	}
 	if closeErr := respose.Body.Close(); closeErr != nil {
 		defPrinter.error("Unable to close response body: %s.", closeErr)
 	}
+	if respose.StatusCode != http.StatusOK {
+		return "", statusError(respose)
+	}
 
 	totalSize := respose.ContentLength
 	if totalSize < 1 {
-		return fmt.Errorf("download too small")
+		return "", fmt.Errorf("download too small")
 	}
 	if respose.Header.Get("Accept-Ranges") != rangeUnits {
-		return fmt.Errorf("server not support Range header")
+		return "", fmt.Errorf("server not support Range header")
 	}
 	if totalSize <= minThreadedSize {
 		threads = 1 // Limit threads to one for small files.
 	}
 
-	fp, openErr := os.Create(path)
+	part := partPath(path)
+	segs := loadSegments(path, totalSize)
+	if segs == nil {
+		// Continue a sequential part, if any, and split the rest between threads.
+		offset, sizeErr := fileSize(part)
+		if sizeErr != nil {
+			return "", sizeErr
+		}
+		if offset > totalSize {
+			if dropErr := dropPart(path); dropErr != nil {
+				return "", dropErr
+			}
+			offset = 0
+		}
+		segs = splitSegments(offset, totalSize, threads)
+	}
+	if len(segs) == 0 {
+		return calcChkSum(part, nil, nil) // Nothing left to fetch, the checksum decides whether the part is good.
+	}
+
+	// The state goes first: once the part is preallocated, its size tells nothing about what is fetched.
+	if saveErr := saveSegments(path, totalSize, segs); saveErr != nil {
+		return "", saveErr
+	}
+	fp, openErr := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
 	if openErr != nil {
-		return openErr
+		return "", openErr
 	}
 	defer func() {
 		if closeErr := fp.Close(); closeErr != nil {
@@ -166,32 +365,39 @@ func getThreaded(url, path string, threads, idx, amount uint) error {
 		}
 	}()
 	if truncErr := truncFile(fp, totalSize); truncErr != nil {
-		return truncErr
+		return "", truncErr
 	}
 
-	report := make(chan int64, 4096)
-	errKeep := newErrKeeper(int(threads))
-
-	partSize := totalSize / int64(threads)
-	rangeStart := int64(0)
-	rangeEnd := partSize
-	for i := uint(0); i < threads-1; i++ {
-		go downPart(errKeep, url, fp, rangeStart, rangeEnd, report)
-		rangeStart += partSize
-		rangeEnd += partSize
+	report := make(chan segReport, 4096)
+	errKeep := newErrKeeper(len(segs))
+	curSize := totalSize
+	for i := range segs {
+		curSize -= segs[i].end - segs[i].done
+		go downPart(errKeep, url, fp, i, segs[i], report)
 	}
-	go downPart(errKeep, url, fp, rangeStart, -1, report)
 
+	// Only this goroutine advances the segments, the state is saved as they progress,
+	// so a killed run is continued from where it stopped.
 	barWg := sync.WaitGroup{}
 	barWg.Add(1)
 	go func() {
 		defer barWg.Done()
-		pb := newProgressBar(idx, amount, filepath.Base(path), totalSize)
-		pb.begin()
-		curSize := int64(0)
-		for readSize := range report {
-			curSize += readSize
+		pb.begin(totalSize)
+		lastSave := time.Now()
+		for rep := range report {
+			segs[rep.idx].done += rep.size
+			curSize += rep.size
 			pb.draw(curSize)
+			if time.Since(lastSave) < stateSaveInterval {
+				continue
+			}
+			// What the state claims must be on disk already.
+			if syncErr := fp.Sync(); syncErr != nil {
+				defPrinter.error("Unable to sync pkg file: %s.", syncErr)
+			} else if saveErr := saveSegments(path, totalSize, segs); saveErr != nil {
+				defPrinter.error("Unable to save download state: %s.", saveErr)
+			}
+			lastSave = time.Now()
 		}
 		pb.end()
 	}()
@@ -201,38 +407,111 @@ func getThreaded(url, path string, threads, idx, amount uint) error {
 	barWg.Wait()
 
 	if syncErr := fp.Sync(); syncErr != nil {
-		return syncErr
+		return "", syncErr
+	}
+	// Remember what is already on disk so the next attempt fetches only the rest.
+	if saveErr := saveSegments(path, totalSize, segs); saveErr != nil {
+		defPrinter.error("Unable to save download state: %s.", saveErr)
 	}
-	return downErr
+	if downErr != nil {
+		return "", downErr
+	}
+	// The part has just been written, so it is hashed from the page cache.
+	return calcChkSum(part, nil, nil)
 }
 
-func downloadFiles(baseUrl, sectionDir string, names []string, threads uint) error {
+func downloadFile(url, path, chksum string, threads uint, pb *progressBar) error {
 	var lastErr error = nil
-	amount := uint(len(names))
-	for i, name := range names {
-		path := filepath.Join(sectionDir, name)
-		attemptsLeft := 2
-	repeatDown:
-		if attemptsLeft == 0 {
-			continue
+	for attemptsLeft := 2; attemptsLeft > 0; attemptsLeft-- {
+		// Without a checksum there is no way to tell a stale part from a good one.
+		if chksum == "" {
+			if dropErr := dropPart(path); dropErr != nil {
+				return dropErr
+			}
 		}
-		if rmErr := rmFile(path); rmErr != nil {
-			return rmErr
-		}
-		idx := uint(i + 1)
-		url := fmt.Sprintf("%s/%s", baseUrl, name)
 		var downErr error = nil
+		var gotSum string
 		if threads == 1 {
-			downErr = getSingle(url, path, idx, amount)
+			gotSum, downErr = getSingle(url, path, pb)
 		} else {
-			downErr = getThreaded(url, path, threads, idx, amount)
+			gotSum, downErr = getThreaded(url, path, threads, pb)
+		}
+		if downErr == nil {
+			downErr = commitPart(path, chksum, gotSum)
 		}
-		if downErr != nil {
-			defPrinter.error("Unable to download file: %s.", downErr)
-			lastErr = downErr
-			attemptsLeft -= 1
-			goto repeatDown
+		if downErr == nil {
+			return nil
 		}
+		if errors.Is(downErr, errNotFound) {
+			return downErr // Retrying won't help, the caller decides whether it is an error.
+		}
+		defPrinter.error("Unable to download file: %s.", downErr)
+		lastErr = downErr
 	}
 	return lastErr
 }
+
+// downloadFiles fetches packages from the queue by a pool of workers, each of them downloads its own package.
+func downloadFiles(ups []*upstream, spread bool, sectionDir string, queue <-chan pkgDesc, threads, jobs uint, cache *chksumCache, sp *syncProgress) error {
+	errKeep := newErrKeeper(int(jobs))
+	for w := uint(0); w < jobs; w++ {
+		go func() {
+			defer errKeep.done()
+			for desc := range queue {
+				idx, amount := sp.nextDownload()
+				path := filepath.Join(sectionDir, desc.fileName)
+				shift := 0
+				if spread {
+					shift = int(idx) % len(ups)
+				}
+				var downErr error = nil
+				for k := range ups {
+					up := ups[(shift+k)%len(ups)]
+					pb := newProgressBar(idx, amount, desc.fileName, urlHost(up.baseUrl), false)
+					downErr = downloadFile(up.fileUrl(desc.fileName), path, desc.chksum, threads, pb)
+					if downErr == nil {
+						up.countServed(1)
+						cache.record(path, desc.chksum)
+						sp.addDownloaded()
+						// The signature may belong to the replaced file, so it is fetched again.
+						if rmErr := rmFile(sigPath(path)); rmErr != nil {
+							defPrinter.error("Unable to remove stale signature: %s.", rmErr)
+						}
+						break
+					}
+					if errors.Is(downErr, errNotFound) {
+						defPrinter.error("Unable to download file: %s.", downErr)
+					}
+				}
+				if downErr != nil {
+					defPrinter.error("No upstream served '%s'.", desc.fileName)
+					errKeep.set(downErr)
+				}
+			}
+		}()
+	}
+	return errKeep.get()
+}
+
+// stageFiles fetches all the files from the first upstream that serves them and returns that upstream.
+func stageFiles(ups []*upstream, sectionDir string, names []string, threads uint) (*upstream, error) {
+	var lastErr error = nil
+	amount := uint(len(names))
+	for _, up := range ups {
+		lastErr = nil
+		for i, name := range names {
+			path := stagedPath(filepath.Join(sectionDir, name))
+			pb := newProgressBar(uint(i+1), amount, filepath.Base(path), urlHost(up.baseUrl), true)
+			if downErr := downloadFile(up.fileUrl(name), path, "", threads, pb); downErr != nil {
+				lastErr = downErr
+				break
+			}
+		}
+		if lastErr == nil {
+			up.countServed(uint(len(names)))
+			return up, nil
+		}
+		defPrinter.error("Upstream '%s' failed to serve databases: %s.", up.baseUrl, lastErr)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const defDowngradeShare = 10
+
+func newestBuildDate(pkgs []pkgDesc) int64 {
+	var result int64
+	for _, desc := range pkgs {
+		result = max(result, desc.buildDate)
+	}
+	return result
+}
+
+func formatBuildDate(buildDate int64) string {
+	return time.Unix(buildDate, 0).UTC().Format(time.DateTime)
+}
+
+// checkDowngrade returns an error if the incoming packages are older than the published ones:
+// either the newest build is older than the recorded one or too many packages go backwards.
+func checkDowngrade(sectionDir, dbArc string, pkgs []pkgDesc, published publishedState, share uint) error {
+	newest := newestBuildDate(pkgs)
+	if newest < published.NewestBuildDate {
+		return fmt.Errorf(
+			"incoming database is older than the published one, its newest build is %s while ours is %s",
+			formatBuildDate(newest), formatBuildDate(published.NewestBuildDate),
+		)
+	}
+
+	pubPath := filepath.Join(sectionDir, dbArc)
+	if !isFileExist(pubPath) {
+		return nil
+	}
+	pubPkgs, loadErr := loadDescFromDB(pubPath)
+	if loadErr != nil {
+		return loadErr
+	}
+	pubByName := make(map[string]pkgDesc, len(pubPkgs))
+	for _, desc := range pubPkgs {
+		pubByName[desc.name] = desc
+	}
+	common := 0
+	backwards := make([]string, 0)
+	for _, desc := range pkgs {
+		pubDesc, found := pubByName[desc.name]
+		if !found {
+			continue
+		}
+		common++
+		if vercmp(desc.version, pubDesc.version) < 0 {
+			backwards = append(backwards, fmt.Sprintf("%s: %s -> %s", desc.name, pubDesc.version, desc.version))
+		}
+	}
+	if common == 0 || uint(len(backwards))*100 <= share*uint(common) {
+		return nil
+	}
+	sort.Strings(backwards)
+	for _, line := range backwards {
+		defPrinter.line("%s", line)
+	}
+	return fmt.Errorf("%d of %d package(s) of incoming database go backwards", len(backwards), common)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// pkgRule tells whether the package matches the rule.
+type pkgRule func(desc *pkgDesc) bool
+
+// pkgFilter narrows the section down to the packages hosted locally: a package is kept
+// if it matches any include rule, or there are none, and matches no exclude rule.
+type pkgFilter struct {
+	include []pkgRule
+	exclude []pkgRule
+	// always names the packages kept regardless of the rules.
+	always map[string]struct{}
+	// rules is the rules as they are set, they tell whether the filter has changed since the last sync.
+	rules string
+}
+
+// parsePkgRule parses one of the rules:
+// 're:<regexp>' matches names by the regexp, 'group:<group>' matches by '%GROUPS%', 'arch:<arch>' matches by '%ARCH%',
+// 'size><MiB>' and 'size<<MiB>' match by the package size, anything else is a name glob.
+func parsePkgRule(raw string) (pkgRule, error) {
+	switch {
+	case strings.HasPrefix(raw, "re:"):
+		expr, compileErr := regexp.Compile(strings.TrimPrefix(raw, "re:"))
+		if compileErr != nil {
+			return nil, fmt.Errorf("invalid rule '%s': %w", raw, compileErr)
+		}
+		return func(desc *pkgDesc) bool { return expr.MatchString(desc.name) }, nil
+	case strings.HasPrefix(raw, "group:"):
+		group := strings.TrimPrefix(raw, "group:")
+		return func(desc *pkgDesc) bool { return slices.Contains(desc.groups, group) }, nil
+	case strings.HasPrefix(raw, "arch:"):
+		arch := strings.TrimPrefix(raw, "arch:")
+		return func(desc *pkgDesc) bool { return desc.arch == arch }, nil
+	case strings.HasPrefix(raw, "size>"), strings.HasPrefix(raw, "size<"):
+		limit, parseErr := strconv.ParseUint(strings.TrimSpace(raw[len("size>"):]), 10, 32)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid rule '%s', expected size in MiB", raw)
+		}
+		size := limit * 1048576
+		if raw[len("size")] == '>' {
+			return func(desc *pkgDesc) bool { return desc.size > size }, nil
+		}
+		return func(desc *pkgDesc) bool { return desc.size < size }, nil
+	default:
+		if _, matchErr := path.Match(raw, ""); matchErr != nil {
+			return nil, fmt.Errorf("invalid rule '%s': %w", raw, matchErr)
+		}
+		return func(desc *pkgDesc) bool {
+			matched, _ := path.Match(raw, desc.name)
+			return matched
+		}, nil
+	}
+}
+
+func parsePkgRules(raws []string) ([]pkgRule, error) {
+	result := make([]pkgRule, 0, len(raws))
+	for _, raw := range raws {
+		rule, parseErr := parsePkgRule(strings.TrimSpace(raw))
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func newPkgFilter(include, exclude []string) (*pkgFilter, error) {
+	includeRules, includeErr := parsePkgRules(include)
+	if includeErr != nil {
+		return nil, includeErr
+	}
+	excludeRules, excludeErr := parsePkgRules(exclude)
+	if excludeErr != nil {
+		return nil, excludeErr
+	}
+	return &pkgFilter{
+		include: includeRules,
+		exclude: excludeRules,
+		always:  make(map[string]struct{}),
+		rules:   fmt.Sprintf("include=%q exclude=%q", include, exclude),
+	}, nil
+}
+
+func matchesAny(rules []pkgRule, desc *pkgDesc) bool {
+	for _, rule := range rules {
+		if rule(desc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *pkgFilter) isKept(desc *pkgDesc) bool {
+	if _, found := f.always[desc.name]; found {
+		return true
+	}
+	if len(f.include) > 0 && !matchesAny(f.include, desc) {
+		return false
+	}
+	return !matchesAny(f.exclude, desc)
+}
+
+// apply returns the packages the filter keeps, a nil filter keeps everything.
+func (f *pkgFilter) apply(pkgs []pkgDesc) []pkgDesc {
+	if f == nil {
+		return pkgs
+	}
+	result := make([]pkgDesc, 0, len(pkgs))
+	for i := range pkgs {
+		if f.isKept(&pkgs[i]) {
+			result = append(result, pkgs[i])
+		}
+	}
+	return result
+}
+
+// String returns the rules, it is empty for a nil filter.
+func (f *pkgFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.rules
+}
+
+// rewriteStagedDBs replaces the staged databases with ones listing only the kept packages, compressed as the extension tells.
+// The upstream signatures don't match the rewritten databases, so they are dropped and the published ones go too.
+func rewriteStagedDBs(sectionDir, ext string, dbFiles []string, kept []pkgDesc) error {
+	keptNames := make(map[string]struct{}, len(kept))
+	for _, desc := range kept {
+		keptNames[desc.fileName] = struct{}{}
+	}
+	for _, name := range dbFiles {
+		dbPath := stagedPath(filepath.Join(sectionDir, name))
+		pkgs, loadErr := loadDescFromDB(dbPath)
+		if loadErr != nil {
+			return loadErr
+		}
+		pkgs = slices.DeleteFunc(pkgs, func(desc pkgDesc) bool {
+			_, found := keptNames[desc.fileName]
+			return !found
+		})
+		if writeErr := writeDB(dbPath, ext, pkgs, true); writeErr != nil {
+			return writeErr
+		}
+		if rmErr := rmFile(stagedPath(filepath.Join(sectionDir, sigPath(name)))); rmErr != nil {
+			return rmErr
+		}
+		defPrinter.info("Database '%s' rewritten with %d package(s).", name, len(pkgs))
+	}
+	return nil
+}
@@ -7,9 +7,17 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"syscall"
 	"time"
 )
 
+const stagedSuffix = ".staged"
+
+func stagedPath(path string) string {
+	return path + stagedSuffix
+}
+
 func truncFile(fp *os.File, size int64) error {
 	size -= 1
 	offset, seekErr := fp.Seek(size, io.SeekStart)
@@ -39,6 +47,49 @@ func rmFile(path string) error {
 	return nil
 }
 
+// moveFile renames the file, or copies it over and removes the source if the target is on another file system.
+func moveFile(srcPath, dstPath string) error {
+	renameErr := os.Rename(srcPath, dstPath)
+	if !errors.Is(renameErr, syscall.EXDEV) {
+		return renameErr
+	}
+	if copyErr := copyFile(srcPath, stagedPath(dstPath)); copyErr != nil {
+		return copyErr
+	}
+	if renameErr = os.Rename(stagedPath(dstPath), dstPath); renameErr != nil {
+		return renameErr
+	}
+	return os.Remove(srcPath)
+}
+
+// isInsideDir tells whether the path is the directory or lies under it.
+func isInsideDir(dir, path string) (bool, error) {
+	absDir, dirErr := filepath.Abs(dir)
+	if dirErr != nil {
+		return false, dirErr
+	}
+	absPath, pathErr := filepath.Abs(path)
+	if pathErr != nil {
+		return false, pathErr
+	}
+	rel, relErr := filepath.Rel(absDir, absPath)
+	if relErr != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, infoErr := os.Stat(path)
+	if infoErr != nil {
+		if os.IsNotExist(infoErr) {
+			return 0, nil
+		}
+		return 0, infoErr
+	}
+	return info.Size(), nil
+}
+
 func isFileExist(path string) bool {
 	info, infoErr := os.Stat(path)
 	if infoErr == nil {
@@ -70,27 +121,51 @@ func mkLastUpdateStamp(rootDir string) error {
 	return tsFile.Sync()
 }
 
-func removeRedundantFiles(sectionDir, sectionName string, pkgs []pkgDesc) error {
-	serviceFiles := map[string]struct{}{
-		fmt.Sprintf("%s.db", sectionName):           {},
-		fmt.Sprintf("%s.db.tar.gz", sectionName):    {},
-		fmt.Sprintf("%s.files", sectionName):        {},
-		fmt.Sprintf("%s.files.tar.gz", sectionName): {},
+// dbFileName returns the name of the section database of the kind ('db' or 'files'),
+// it is the archive itself if there is no extension.
+func dbFileName(sectionName, kind, ext string) string {
+	if ext == "" {
+		return fmt.Sprintf("%s.%s", sectionName, kind)
+	}
+	return fmt.Sprintf("%s.%s.%s", sectionName, kind, ext)
+}
+
+// findRedundantFiles returns the files of the section which are not in the package set,
+// along with the amount of files it has besides the databases.
+func findRedundantFiles(sectionDir, sectionName, ext string, pkgs []pkgDesc) ([]string, int, error) {
+	serviceFiles := make(map[string]struct{}, 16)
+	for _, name := range []string{
+		fmt.Sprintf("%s.db", sectionName),
+		dbFileName(sectionName, "db", ext),
+		fmt.Sprintf("%s.files", sectionName),
+		dbFileName(sectionName, "files", ext),
+	} {
+		serviceFiles[name] = struct{}{}
+		serviceFiles[sigPath(name)] = struct{}{}
+		serviceFiles[stagedPath(name)] = struct{}{}
+		serviceFiles[stagedPath(sigPath(name))] = struct{}{}
 	}
-	pkgNames := make(map[string]struct{}, len(pkgs))
+	pkgNames := make(map[string]struct{}, len(pkgs)*4)
 	for _, desc := range pkgs {
-		pkgNames[desc.name] = struct{}{}
+		pkgNames[desc.fileName] = struct{}{}
+		pkgNames[sigPath(desc.fileName)] = struct{}{}
+		pkgNames[partPath(desc.fileName)] = struct{}{}
+		pkgNames[statePath(desc.fileName)] = struct{}{}
 	}
 	entries, lookErr := os.ReadDir(sectionDir)
 	if lookErr != nil {
-		return lookErr
+		if os.IsNotExist(lookErr) {
+			return nil, 0, nil
+		}
+		return nil, 0, lookErr
 	}
 	var found bool
-	result := make([]string, 0, len(pkgs))
+	present := 0
+	result := make([]string, 0)
 	for _, entry := range entries {
 		info, infoErr := entry.Info()
 		if infoErr != nil {
-			return infoErr
+			return nil, 0, infoErr
 		}
 		path := info.Name()
 		if info.Mode().IsDir() {
@@ -98,54 +173,124 @@ func removeRedundantFiles(sectionDir, sectionName string, pkgs []pkgDesc) error
 			continue
 		}
 		name := filepath.Base(path)
-		_, found = pkgNames[name]
+		_, found = serviceFiles[name]
 		if found {
 			continue
 		}
-		_, found = serviceFiles[name]
+		present++
+		_, found = pkgNames[name]
 		if found {
 			continue
 		}
 		result = append(result, path)
 	}
-	if len(result) == 0 {
+	sort.Strings(result)
+	return result, present, nil
+}
+
+// checkDeleteLimit lists the files and returns an error if removing them exceeds the limit.
+func checkDeleteLimit(limit deleteLimit, redundant []string, present int) error {
+	if !limit.isExceeded(len(redundant), present) {
 		return nil
 	}
+	for _, path := range redundant {
+		defPrinter.line("%s", path)
+	}
+	return fmt.Errorf("%d of %d file(s) would be removed, it is over the limit of %s", len(redundant), present, limit)
+}
+
+// removeRedundantFiles removes the files which are not in the package set,
+// packages and their signatures are moved to the attic instead if it is set; the moved packages are returned.
+func removeRedundantFiles(sectionDir, sectionName, ext string, pkgs []pkgDesc, atticDir string) ([]string, error) {
+	result, _, findErr := findRedundantFiles(sectionDir, sectionName, ext, pkgs)
+	if findErr != nil {
+		return nil, findErr
+	}
+	moved := make([]string, 0)
+	if len(result) == 0 {
+		return moved, nil
+	}
 	defPrinter.info("Removing redundant files...")
-	sort.Strings(result)
 	for _, path := range result {
+		if atticDir != "" && isPkgFile(path) {
+			defPrinter.line("%s -> attic", path)
+			if mvErr := moveToAttic(sectionDir, atticDir, path); mvErr != nil {
+				defPrinter.error("Unable to move redundant file to attic: %s.", mvErr)
+			} else {
+				moved = append(moved, path)
+			}
+			continue
+		}
 		defPrinter.line("%s", path)
 		if rmErr := os.Remove(filepath.Join(sectionDir, path)); rmErr != nil {
 			defPrinter.error("Unable to remove redundant file: %s.", rmErr)
 		}
 	}
 	defPrinter.info("Cleanup completed.")
+	return moved, nil
+}
+
+func publishFiles(sectionDir string, names []string) error {
+	for _, name := range names {
+		path := filepath.Join(sectionDir, name)
+		if renameErr := os.Rename(stagedPath(path), path); renameErr != nil {
+			return renameErr
+		}
+		defPrinter.info("Database '%s' published.", name)
+		// The signature goes together with its database, a stale one must not outlive it.
+		if !isFileExist(stagedPath(sigPath(path))) {
+			if rmErr := rmFile(sigPath(path)); rmErr != nil {
+				return rmErr
+			}
+			continue
+		}
+		if renameErr := os.Rename(stagedPath(sigPath(path)), sigPath(path)); renameErr != nil {
+			return renameErr
+		}
+		defPrinter.info("Signature '%s' published.", sigPath(name))
+	}
 	return nil
 }
 
-func fixupSymlinks(sectionDir, sectionName string) error {
-	type pair struct {
-		link, arc string
+func updateSymlink(sectionDir, linkName, targetName string) error {
+	linkPath := filepath.Join(sectionDir, linkName)
+	tmpPath := stagedPath(linkPath)
+	if rmErr := rmFile(tmpPath); rmErr != nil {
+		return rmErr
+	}
+	if linkErr := os.Symlink(targetName, tmpPath); linkErr != nil {
+		return linkErr
 	}
-	exts := []pair{
-		{link: "db", arc: "tar.gz"},
-		{link: "files", arc: "tar.gz"},
+	if renameErr := os.Rename(tmpPath, linkPath); renameErr != nil {
+		return renameErr
 	}
-	for _, ext := range exts {
-		linkName := fmt.Sprintf("%s.%s", sectionName, ext.link)
-		linkPath := filepath.Join(sectionDir, linkName)
-		targetName := fmt.Sprintf("%s.%s.%s", sectionName, ext.link, ext.arc)
+	defPrinter.info("Symlink '%s' updated.", linkName)
+	return nil
+}
+
+func fixupSymlinks(sectionDir, sectionName, ext string) error {
+	if ext == "" {
+		return nil // Databases are published under their own names, no links needed.
+	}
+	for _, kind := range []string{"db", "files"} {
+		linkName := fmt.Sprintf("%s.%s", sectionName, kind)
+		targetName := dbFileName(sectionName, kind, ext)
 		targetPath := filepath.Join(sectionDir, targetName)
 		if !isFileExist(targetPath) {
 			return fmt.Errorf("'%s' is not exist as symlink target", targetPath)
 		}
-		if rmErr := rmFile(linkPath); rmErr != nil {
-			return rmErr
+		if linkErr := updateSymlink(sectionDir, linkName, targetName); linkErr != nil {
+			return linkErr
+		}
+		if !isFileExist(sigPath(targetPath)) {
+			if rmErr := rmFile(filepath.Join(sectionDir, sigPath(linkName))); rmErr != nil {
+				return rmErr
+			}
+			continue
 		}
-		if linkErr := os.Symlink(targetName, linkPath); linkErr != nil {
+		if linkErr := updateSymlink(sectionDir, sigPath(linkName), sigPath(targetName)); linkErr != nil {
 			return linkErr
 		}
-		defPrinter.info("Symlink '%s' updated.", linkName)
 	}
 	return nil
 }
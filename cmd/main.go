@@ -3,58 +3,267 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
-func syncSection(uri, arch, sectionName, rootDir string, threads uint) error {
-	sectionDir := filepath.Join(rootDir, arch, sectionName)
+type syncOptions struct {
+	threads        uint
+	jobs           uint
+	force          bool
+	deep           bool
+	verifyJobs     uint
+	limiter        *rateLimiter
+	keys           openpgp.EntityList
+	trust          *keyTrust
+	allowDowngrade bool
+	downgradeShare uint
+	deleteLimit    deleteLimit
+	ignoreLimit    bool
+	attic          *atticPolicy
+	filter         *pkgFilter
+	quarantineDir  string
+}
+
+// checksSignatures tells whether package signatures are checked, the keys of the keyring section may be unknown yet.
+func (o *syncOptions) checksSignatures() bool {
+	return o.keys != nil || o.trust != nil
+}
+
+// sectionKeys returns the keys signatures are checked against, nil means no checks.
+func (o *syncOptions) sectionKeys() openpgp.EntityList {
+	if o.trust != nil {
+		return o.trust.keys
+	}
+	return o.keys
+}
+
+// bootstrapPublished takes the keys from the keyring package of the published database,
+// it is for the keyring section which is not synced this time.
+func (o *syncOptions) bootstrapPublished(sectionDir, sectionName, dbArc string) error {
+	if o.trust == nil || sectionName != o.trust.section {
+		return nil
+	}
+	pubPkgs, loadErr := loadDescFromDB(filepath.Join(sectionDir, dbArc))
+	if loadErr != nil {
+		return loadErr
+	}
+	return o.trust.bootstrap(sectionDir, pubPkgs, o.limiter)
+}
+
+// syncSection returns whether the section is published anew, a skipped one is left as it is.
+func syncSection(mirror *netMirror, sectionName, rootDir string, opts *syncOptions) (bool, error) {
+	sectionDir := filepath.Join(rootDir, mirror.Arch, sectionName)
 	if mkdirErr := os.MkdirAll(sectionDir, 0755); mkdirErr != nil {
-		return mkdirErr
+		return false, mkdirErr
+	}
+	// Checks must not be skipped silently because the keyring section failed to provide the keys.
+	if opts.trust != nil && sectionName != opts.trust.section && opts.trust.keys == nil {
+		return false, fmt.Errorf("no keys are taken from keyring package '%s'", opts.trust.pkgName)
+	}
+
+	dbExt := mirror.dbExt(sectionName)
+	dbArc := dbFileName(sectionName, "db", dbExt)
+
+	stateDir := sectionStateDir(rootDir, mirror.Arch, sectionName)
+	if pin := loadPin(stateDir); pin.Snapshot != "" {
+		defPrinter.info("Section '%s' is pinned to snapshot '%s', skipped.", sectionName, pin.Snapshot)
+		// The keys of the pinned keyring section are still needed for the other sections.
+		return false, opts.bootstrapPublished(sectionDir, sectionName, dbArc)
 	}
 
-	dbArc := fmt.Sprintf("%s.db.tar.gz", sectionName)
 	dbFiles := []string{
+		dbFileName(sectionName, "files", dbExt),
 		dbArc,
-		fmt.Sprintf("%s.files.tar.gz", sectionName),
 	}
-	baseUrl := formatUrl(uri, arch, sectionName)
+	allUps := newUpstreams(append(mirror.dbUpstreams(), mirror.pkgUpstreams()...), mirror.Arch, sectionName, nil)
+	dbUps := newUpstreams(mirror.dbUpstreams(), mirror.Arch, sectionName, allUps)
+	pkgUps := newUpstreams(mirror.pkgUpstreams(), mirror.Arch, sectionName, allUps)
+
+	published := loadPublishedState(stateDir)
+	probedUp, validator, unchanged := probeFile(dbUps, dbArc, loadValidator(stateDir))
+	// Changed filters have to be applied even if the upstream is the same.
+	unchanged = unchanged && published.Filter == opts.filter.String()
+	if unchanged && !opts.force && !opts.deep && isSectionIntact(sectionDir, sectionName, dbArc) {
+		defPrinter.info("Section '%s' is not changed upstream, skipped.", sectionName)
+		// The published keyring package still has to provide the keys for the other sections.
+		return false, opts.bootstrapPublished(sectionDir, sectionName, dbArc)
+	}
 
-	var downErr error
-	if downErr = downloadFiles(baseUrl, sectionDir, dbFiles, threads); downErr != nil {
-		return downErr
+	// New databases are staged aside and published only when all their packages are in place.
+	dbUp, downErr := stageFiles(dbUps, sectionDir, dbFiles, opts.threads)
+	if downErr != nil {
+		return false, downErr
+	}
+	if sigErr := stageSignatures(dbUp, sectionDir, dbFiles, opts.threads); sigErr != nil {
+		return false, sigErr
+	}
+	if keys := opts.sectionKeys(); keys != nil {
+		if sigErr := checkDbSignatures(keys, sectionDir, dbFiles); sigErr != nil {
+			return false, sigErr
+		}
 	}
 
-	allPkgs, loadErr := loadDescFromDB(filepath.Join(sectionDir, dbArc))
+	allPkgs, loadErr := loadDescFromDB(stagedPath(filepath.Join(sectionDir, dbArc)))
 	if loadErr != nil {
-		return loadErr
+		return false, loadErr
+	}
+	if downErr := checkDowngrade(sectionDir, dbArc, allPkgs, published, opts.downgradeShare); downErr != nil {
+		if !opts.allowDowngrade {
+			return false, fmt.Errorf("%w, use -allow-downgrade to accept it", downErr)
+		}
+		defPrinter.error("Accepting downgrade: %s.", downErr)
+	}
+	pkgs := opts.filter.apply(allPkgs)
+	if opts.filter != nil {
+		defPrinter.info("Filters keep %d of %d package(s).", len(pkgs), len(allPkgs))
+	}
+	rejected := rejectedPkgs{}
+	skipped := make([]string, 0)
+	if opts.checksSignatures() {
+		rejected = loadRejectedPkgs(stateDir)
+		if !opts.deep {
+			pkgs, skipped = skipRejectedPkgs(pkgs, rejected)
+		}
+	}
+	// A truncated or bogus database must not wipe the section, so removals are checked before anything changes.
+	redundant, present, findErr := findRedundantFiles(sectionDir, sectionName, dbExt, pkgs)
+	if findErr != nil {
+		return false, findErr
+	}
+	if limitErr := checkDeleteLimit(opts.deleteLimit, redundant, present); limitErr != nil {
+		if !opts.ignoreLimit {
+			return false, fmt.Errorf("%w, use -ignore-delete-limit to proceed", limitErr)
+		}
+		defPrinter.error("Ignoring delete limit: %s.", limitErr)
 	}
 
-	updatedOk := false
-	for attempt := 1; attempt <= 2; attempt++ {
-		needUpdPkgs, checkErr := getPkgsToUpdate(sectionDir, allPkgs)
-		if checkErr != nil {
-			return checkErr
+	cache := loadChksumCache(stateDir, opts.deep)
+	verif := &verifier{cache: cache, limiter: opts.limiter, jobs: opts.verifyJobs}
+	// Downloading starts as soon as verification finds the first package to update.
+	sp := &syncProgress{total: len(pkgs)}
+	queue := make(chan pkgDesc, len(pkgs))
+	downResult := make(chan error, 1)
+	go func() {
+		downResult <- downloadFiles(pkgUps, mirror.spreadPkgs(), sectionDir, queue, opts.threads, opts.jobs, cache, sp)
+	}()
+	if !defPrinter.isVerbose() {
+		defPrinter.info("Checking packages...")
+	}
+	missing, broken, checkErr := checkPackages(sectionDir, pkgs, verif, queue, sp)
+	close(queue)
+	downErr = <-downResult
+	defPrinter.setStatus("")
+	if saveErr := cache.save(pkgs); saveErr != nil {
+		defPrinter.error("Unable to save checksum cache: %s.", saveErr)
+	}
+	if checkErr != nil {
+		return false, checkErr
+	}
+	if missing == 0 && broken == 0 {
+		defPrinter.line("Checking packages: OK.")
+	} else {
+		defPrinter.line("Checking packages: %d missing, %d broken, %d downloaded.", missing, broken, sp.downloaded)
+	}
+	if downErr != nil {
+		return false, downErr
+	}
+	if sigErr := syncSignatures(pkgUps, sectionDir, pkgs, opts.jobs); sigErr != nil {
+		return false, sigErr
+	}
+	if opts.trust != nil && sectionName == opts.trust.section {
+		if trustErr := opts.trust.bootstrap(sectionDir, pkgs, opts.limiter); trustErr != nil {
+			return false, trustErr
 		}
-		if len(needUpdPkgs) == 0 {
-			updatedOk = true
-			break
+		if sigErr := checkDbSignatures(opts.trust.keys, sectionDir, dbFiles); sigErr != nil {
+			return false, sigErr
 		}
-		defPrinter.info("Updating packages...")
-		names := namesFromDescs(needUpdPkgs)
-		if downErr = downloadFiles(baseUrl, sectionDir, names, threads); downErr != nil {
-			return downErr
+	}
+	if keys := opts.sectionKeys(); keys != nil {
+		bad, sigErr := checkPkgSignatures(keys, sectionDir, stateDir, pkgs, verif, opts.deep)
+		if sigErr != nil {
+			return false, sigErr
+		}
+		// Rejected packages are left out of the databases, the published ones still list them until they are replaced.
+		pkgs, rejected = rejectPkgs(pkgs, bad, skipped, rejected, keys)
+		if len(rejected.Chksums) > 0 {
+			defPrinter.error("%d package(s) failed signature check and are not published.", len(rejected.Chksums))
 		}
 	}
-	if !updatedOk {
-		return fmt.Errorf("unable to update packages, all attempts failed")
+	for _, up := range allUps {
+		defPrinter.info("Upstream '%s' served %d file(s).", up.baseUrl, up.served)
 	}
 
-	if rmErr := removeRedundantFiles(sectionDir, sectionName, allPkgs); rmErr != nil {
-		return rmErr
+	if len(pkgs) < len(allPkgs) {
+		if rewriteErr := rewriteStagedDBs(sectionDir, dbExt, dbFiles, pkgs); rewriteErr != nil {
+			return false, rewriteErr
+		}
+	}
+	// Descriptions of the packages about to be superseded are only in the published database,
+	// the files one is read for their file lists, skipping the entries of the packages which stay.
+	superseded := make([]pkgDesc, 0)
+	if pubFiles := filepath.Join(sectionDir, dbFileName(sectionName, "files", dbExt)); opts.attic != nil && isFileExist(pubFiles) {
+		redundantNames := make(map[string]struct{}, len(redundant))
+		for _, name := range redundant {
+			redundantNames[name] = struct{}{}
+		}
+		var loadErr error
+		superseded, loadErr = loadSomeDescFromDB(pubFiles, func(fileName string) bool {
+			_, found := redundantNames[fileName]
+			return found
+		})
+		if loadErr != nil {
+			return false, loadErr
+		}
+	}
+	if pubErr := publishFiles(sectionDir, dbFiles); pubErr != nil {
+		return false, pubErr
+	}
+	if linkErr := fixupSymlinks(sectionDir, sectionName, dbExt); linkErr != nil {
+		return false, linkErr
+	}
+	if opts.checksSignatures() {
+		names := make([]string, 0, len(rejected.Chksums))
+		for name := range rejected.Chksums {
+			names = append(names, name)
+		}
+		if quarErr := quarantinePkgs(sectionDir, opts.quarantineDir, names); quarErr != nil {
+			return false, quarErr
+		}
+		if saveErr := saveRejectedPkgs(stateDir, rejected); saveErr != nil {
+			return false, saveErr
+		}
+	}
+	atticDir := ""
+	if opts.attic != nil {
+		atticDir = sectionAtticDir(rootDir, mirror.Arch, sectionName)
+	}
+	moved, rmErr := removeRedundantFiles(sectionDir, sectionName, dbExt, pkgs, atticDir)
+	if rmErr != nil {
+		return false, rmErr
+	}
+	if opts.attic != nil {
+		if pruneErr := pruneAttic(atticDir, stateDir, moved, opts.attic); pruneErr != nil {
+			return false, pruneErr
+		}
+		if dbErr := updateAtticDB(atticDir, superseded); dbErr != nil {
+			return false, dbErr
+		}
+	}
+	// The newest build is of the whole upstream database, so changed filters don't look like a downgrade.
+	published = publishedState{NewestBuildDate: newestBuildDate(allPkgs), Filter: opts.filter.String()}
+	if saveErr := savePublishedState(stateDir, published); saveErr != nil {
+		return false, saveErr
+	}
+	// The validator is trusted only when it describes the very copy of the DB that was published.
+	if probedUp == nil || probedUp != dbUp {
+		validator = dbValidator{}
 	}
-	return fixupSymlinks(sectionDir, sectionName)
+	return true, saveValidator(stateDir, validator)
 }
 
 func syncLocalMirror() error {
@@ -63,18 +272,46 @@ func syncLocalMirror() error {
 	var rootDir string
 	var mirrorNames string
 	var listMirrors bool
+	var forceSync bool
+	var deepVerify bool
+	var allowDowngrade bool
+	var ignoreLimit bool
+	var rollbackDay string
+	var unpin bool
+	var target string
+	var diffMode bool
+	var diffJson bool
 
 	flag.BoolVar(&beQuiet, "quiet", false, "quiet mode")
 	flag.StringVar(&cfgPath, "config", "~/.config/amt.toml", "config file path")
 	flag.StringVar(&rootDir, "rootdir", "", "root directory (read from config, use current if not set)")
 	flag.StringVar(&mirrorNames, "mirrors", "", "mirrors (read from config, use enabled if set)")
 	flag.BoolVar(&listMirrors, "list", false, "list configured mirrors and quit")
+	flag.BoolVar(&forceSync, "force", false, "sync sections even if upstream databases are not changed")
+	flag.BoolVar(&deepVerify, "deep-verify", false, "re-hash all packages ignoring the checksum cache")
+	flag.BoolVar(&allowDowngrade, "allow-downgrade", false, "accept databases older than the published ones")
+	flag.BoolVar(&ignoreLimit, "ignore-delete-limit", false, "remove redundant files even if there are more than the limit")
+	flag.StringVar(&rollbackDay, "rollback", "", "republish the target from the snapshot of the day (YYYY/MM/DD) and pin it")
+	flag.BoolVar(&unpin, "unpin", false, "resume syncing of the pinned target")
+	flag.StringVar(&target, "target", "", "target of rollback or unpin: <arch> or <arch>/<section>")
+	flag.BoolVar(&diffMode, "diff", false, "compare two databases given as paths or URLs: -diff <old> <new>")
+	flag.BoolVar(&diffJson, "json", false, "print the diff as JSON")
 	flag.Parse()
 
 	if beQuiet {
 		defPrinter.setQuiet()
 	}
 
+	if diffMode {
+		if flag.NArg() != 2 {
+			return fmt.Errorf("diff needs two databases, got %d", flag.NArg())
+		}
+		if diffJson {
+			defPrinter.setSilent()
+		}
+		return diffRepos(flag.Arg(0), flag.Arg(1), diffJson)
+	}
+
 	cfg, cfgErr := readConfig(cfgPath)
 	if cfgErr != nil {
 		return cfgErr
@@ -90,8 +327,10 @@ func syncLocalMirror() error {
 				mark = '*'
 			}
 			fmt.Printf(
-				"%c%s {\n\turi: %s\n\tarch: %s\n\tsections: [%s]\n}\n",
-				mark, name, mirror.Uri, mirror.Arch, strings.Join(mirror.Sections, ","),
+				"%c%s {\n\tdb uris: [%s]\n\tpkg uris: [%s]\n\tarch: %s\n\tsections: [%s]\n}\n",
+				mark, name,
+				strings.Join(mirror.dbUpstreams(), ","), strings.Join(mirror.pkgUpstreams(), ","),
+				mirror.Arch, strings.Join(mirror.Sections, ","),
 			)
 		}
 		return nil
@@ -108,6 +347,13 @@ func syncLocalMirror() error {
 		}
 	}
 
+	if rollbackDay != "" {
+		return rollbackTarget(rootDir, rollbackDay, target)
+	}
+	if unpin {
+		return unpinTarget(rootDir, target)
+	}
+
 	enabledNames := make([]string, 0)
 	if mirrorNames == "" {
 		for name, mirror := range cfg.Mirrors {
@@ -130,27 +376,134 @@ func syncLocalMirror() error {
 		return fmt.Errorf("no enabled mirrors found in config '%s'", cfgPath)
 	}
 
+	verifyJobs := cfg.VerifyJobs
+	if verifyJobs == 0 {
+		verifyJobs = 1
+	} else if verifyJobs > 64 {
+		defPrinter.error("Wrong amount of verify jobs %d, reset to 1.", verifyJobs)
+		verifyJobs = 1
+	}
+	// The limiter is shared by all sections, so the cap holds for the whole run.
+	limiter := newRateLimiter(cfg.VerifyRate)
+	downgradeShare := cfg.DowngradeShare
+	if downgradeShare == 0 {
+		downgradeShare = defDowngradeShare
+	} else if downgradeShare > 100 {
+		defPrinter.error("Wrong downgrade share %d%%, reset to %d%%.", downgradeShare, defDowngradeShare)
+		downgradeShare = defDowngradeShare
+	}
+
+	snapPolicy := cfg.Snapshots.policy()
+	// Rejected packages must not be served, so they are kept out of the published tree.
+	if cfg.QuarantineDir != "" {
+		inside, insideErr := isInsideDir(rootDir, cfg.QuarantineDir)
+		if insideErr != nil {
+			return insideErr
+		}
+		if inside {
+			return fmt.Errorf("quarantine directory '%s' is inside root directory '%s'", cfg.QuarantineDir, rootDir)
+		}
+	}
+
 	defPrinter.info("Using '%s' as root directory.", rootDir)
 	for midx, name := range enabledNames {
 		mirror := cfg.Mirrors[name]
-		for sidx, section := range mirror.Sections {
+		if len(mirror.dbUpstreams()) == 0 || len(mirror.pkgUpstreams()) == 0 {
+			return fmt.Errorf("no upstream URIs configured for mirror '%s'", name)
+		}
+		keys, keysErr := loadKeyring(mirror.Keyring)
+		if keysErr != nil {
+			return keysErr
+		}
+		var trust *keyTrust
+		if mirror.KeyringPkg != "" {
+			if keys != nil {
+				return fmt.Errorf("mirror '%s' has both 'keyring' and 'keyring_pkg' set", name)
+			}
+			if !slices.Contains(mirror.Sections, mirror.keyringSection()) {
+				return fmt.Errorf("keyring section '%s' is not synced for mirror '%s'", mirror.keyringSection(), name)
+			}
+			var trustErr error
+			if trust, trustErr = newKeyTrust(mirror.KeyringPkg, mirror.keyringSection(), mirror.MasterKeys); trustErr != nil {
+				return trustErr
+			}
+		}
+		for sidx, section := range mirror.orderedSections() {
 			threads := mirror.Threads
 			if threads == 0 || threads > 8 {
 				defPrinter.error("Wrong amount of threads %d, reset to 1.", threads)
 				threads = 1
 			}
+			jobs := mirror.Jobs
+			if jobs == 0 {
+				jobs = 1
+			} else if jobs > 32 {
+				defPrinter.error("Wrong amount of jobs %d, reset to 1.", jobs)
+				jobs = 1
+			}
+			limit, limitErr := mirror.deleteLimit(section)
+			if limitErr != nil {
+				return fmt.Errorf("section '%s' of mirror '%s': %w", section, name, limitErr)
+			}
+			filter, filterErr := mirror.pkgFilter(section)
+			if filterErr != nil {
+				return fmt.Errorf("section '%s' of mirror '%s': %w", section, name, filterErr)
+			}
+			if _, found := dbCompressors[mirror.dbExt(section)]; filter != nil && !found {
+				return fmt.Errorf(
+					"section '%s' of mirror '%s': filtered databases can't be written as '%s'",
+					section, name, mirror.dbExt(section),
+				)
+			}
+			if filter != nil && trust != nil && section == trust.section {
+				// The keys of the other sections come from the keyring package, so it is hosted regardless of the rules.
+				filter.always[trust.pkgName] = struct{}{}
+			}
 			defPrinter.info(
-				"Syncing section '%s' (%d/%d), mirror '%s'@%s (th=%d) (%d/%d)...",
+				"Syncing section '%s' (%d/%d), mirror '%s'@%s (th=%d, jobs=%d) (%d/%d)...",
 				section, sidx+1, len(mirror.Sections),
-				name, mirror.Arch, threads, midx+1, enabledCount,
+				name, mirror.Arch, threads, jobs, midx+1, enabledCount,
 			)
-			if syncErr := syncSection(mirror.Uri, mirror.Arch, section, rootDir, threads); syncErr != nil {
+			quarantineDir := ""
+			if cfg.QuarantineDir != "" {
+				quarantineDir = filepath.Join(cfg.QuarantineDir, mirror.Arch, section)
+			}
+			opts := syncOptions{
+				threads:        threads,
+				jobs:           jobs,
+				force:          forceSync,
+				deep:           deepVerify,
+				verifyJobs:     verifyJobs,
+				limiter:        limiter,
+				keys:           keys,
+				trust:          trust,
+				allowDowngrade: allowDowngrade,
+				downgradeShare: downgradeShare,
+				deleteLimit:    limit,
+				ignoreLimit:    ignoreLimit,
+				attic:          cfg.Attic.policy(),
+				filter:         filter,
+				quarantineDir:  quarantineDir,
+			}
+			published, syncErr := syncSection(&mirror, section, rootDir, &opts)
+			if syncErr != nil {
 				return syncErr
 			}
+			// A skipped section is the same as in the snapshot of the day, unless there is none yet.
+			if snapPolicy != nil && (published || !isSnapshotTaken(rootDir, mirror.Arch, section, time.Now())) {
+				if snapErr := takeSnapshot(rootDir, mirror.Arch, section, time.Now()); snapErr != nil {
+					return snapErr
+				}
+			}
 			defPrinter.info("Syncing section '%s', mirror '%s': done.", section, name)
 		}
 	}
 
+	if snapPolicy != nil {
+		if pruneErr := pruneSnapshots(rootDir, snapPolicy, time.Now()); pruneErr != nil {
+			return pruneErr
+		}
+	}
 	if tsErr := mkLastUpdateStamp(rootDir); tsErr != nil {
 		return tsErr
 	}
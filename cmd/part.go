@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	partSuffix  = ".part"
+	stateSuffix = ".state"
+)
+
+type segment struct {
+	start int64
+	end   int64
+	done  int64
+}
+
+func partPath(path string) string {
+	return path + partSuffix
+}
+
+func statePath(path string) string {
+	return partPath(path) + stateSuffix
+}
+
+func splitSegments(offset, totalSize int64, threads uint) []segment {
+	result := make([]segment, 0, threads)
+	if offset >= totalSize {
+		return result
+	}
+	partSize := (totalSize - offset) / int64(threads)
+	start := offset
+	for i := uint(0); i < threads; i++ {
+		end := start + partSize
+		if i == threads-1 {
+			end = totalSize
+		}
+		if end > start {
+			result = append(result, segment{start: start, end: end, done: start})
+		}
+		start = end
+	}
+	return result
+}
+
+// loadSegments returns the unfinished segments of the threaded download
+// or nil if there is no usable state, in which case the stale part is dropped.
+func loadSegments(path string, totalSize int64) []segment {
+	stateFile, openErr := os.Open(statePath(path))
+	if openErr != nil {
+		if !os.IsNotExist(openErr) {
+			defPrinter.error("Unable to open download state: %s.", openErr)
+		}
+		return nil
+	}
+	defer func() {
+		if closeErr := stateFile.Close(); closeErr != nil {
+			defPrinter.error("Unable to close download state: %s.", closeErr)
+		}
+	}()
+	result := make([]segment, 0)
+	scanner := bufio.NewScanner(stateFile)
+	valid := scanner.Scan() && scanner.Text() == strconv.FormatInt(totalSize, 10)
+	for valid && scanner.Scan() {
+		var seg segment
+		_, scanErr := fmt.Sscanf(scanner.Text(), "%d %d %d", &seg.start, &seg.end, &seg.done)
+		if scanErr != nil || seg.start > seg.done || seg.done > seg.end || seg.end > totalSize {
+			valid = false
+			break
+		}
+		if seg.done < seg.end {
+			result = append(result, seg)
+		}
+	}
+	if valid && scanner.Err() == nil {
+		return result
+	}
+	defPrinter.error("Download state of '%s' is stale, starting over.", filepath.Base(path))
+	if dropErr := dropPart(path); dropErr != nil {
+		defPrinter.error("Unable to drop stale part: %s.", dropErr)
+	}
+	return nil
+}
+
+func saveSegments(path string, totalSize int64, segs []segment) error {
+	var lines strings.Builder
+	lines.WriteString(fmt.Sprintf("%d\n", totalSize))
+	for _, seg := range segs {
+		if seg.done < seg.end {
+			lines.WriteString(fmt.Sprintf("%d %d %d\n", seg.start, seg.end, seg.done))
+		}
+	}
+	tmpPath := stagedPath(statePath(path))
+	if writeErr := os.WriteFile(tmpPath, []byte(lines.String()), 0644); writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tmpPath, statePath(path))
+}
+
+func dropPart(path string) error {
+	if rmErr := rmFile(statePath(path)); rmErr != nil {
+		return rmErr
+	}
+	return rmFile(partPath(path))
+}
+
+// commitPart moves the completed part into place once its checksum matches the expected one.
+func commitPart(path, chksum, gotSum string) error {
+	part := partPath(path)
+	if chksum != "" {
+		if gotSum != chksum {
+			if dropErr := dropPart(path); dropErr != nil {
+				return dropErr
+			}
+			return fmt.Errorf("checksum mismatch for '%s'", filepath.Base(path))
+		}
+	}
+	if rmErr := rmFile(statePath(path)); rmErr != nil {
+		return rmErr
+	}
+	return os.Rename(part, path)
+}
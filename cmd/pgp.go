@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgpErrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+)
+
+var armorPrefix = []byte("-----BEGIN PGP")
+
+func parseKeys(data []byte) (openpgp.EntityList, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), armorPrefix) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+func readKeyFile(path string) (openpgp.EntityList, error) {
+	data, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	keys, keysErr := parseKeys(data)
+	if keysErr != nil {
+		return nil, fmt.Errorf("unable to read keys from '%s': %w", path, keysErr)
+	}
+	return keys, nil
+}
+
+// loadKeyring reads public keys from the file or from all the files in the directory,
+// nil means that signatures are not verified.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	info, infoErr := os.Stat(path)
+	if infoErr != nil {
+		return nil, infoErr
+	}
+	paths := []string{path}
+	if info.IsDir() {
+		entries, lookErr := os.ReadDir(path)
+		if lookErr != nil {
+			return nil, lookErr
+		}
+		paths = paths[:0]
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				paths = append(paths, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	result := make(openpgp.EntityList, 0)
+	for _, keyPath := range paths {
+		keys, keysErr := readKeyFile(keyPath)
+		if keysErr != nil {
+			return nil, keysErr
+		}
+		result = append(result, keys...)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no keys found in '%s'", path)
+	}
+	defPrinter.info("Loaded %d key(s) from '%s'.", len(result), path)
+	return result, nil
+}
+
+// checkSignature verifies the file against its detached signature, either binary or armored.
+func checkSignature(keys openpgp.EntityList, path, sigFile string, limiter *rateLimiter) error {
+	sig, readErr := os.ReadFile(sigFile)
+	if readErr != nil {
+		return readErr
+	}
+	signedFile, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer func() {
+		if closeErr := signedFile.Close(); closeErr != nil {
+			panic(fmt.Sprintf("Unable check signature: %s.", path))
+		}
+	}()
+	var reader io.Reader = signedFile
+	if limiter != nil {
+		reader = &throttledReader{reader: signedFile, limiter: limiter}
+	}
+	var checkErr error
+	if bytes.HasPrefix(bytes.TrimSpace(sig), armorPrefix) {
+		_, checkErr = openpgp.CheckArmoredDetachedSignature(keys, reader, bytes.NewReader(sig), nil)
+	} else {
+		_, checkErr = openpgp.CheckDetachedSignature(keys, reader, bytes.NewReader(sig), nil)
+	}
+	// Packager keys expire routinely while the packages they signed are still valid.
+	if errors.Is(checkErr, pgpErrors.ErrKeyExpired) {
+		return nil
+	}
+	return checkErr
+}
+
+// checkDbSignatures verifies the staged databases, unsigned ones are accepted as pacman does by default.
+func checkDbSignatures(keys openpgp.EntityList, sectionDir string, names []string) error {
+	for _, name := range names {
+		path := stagedPath(filepath.Join(sectionDir, name))
+		if !isFileExist(stagedPath(filepath.Join(sectionDir, sigPath(name)))) {
+			defPrinter.info("Database '%s' is not signed.", name)
+			continue
+		}
+		if checkErr := checkSignature(keys, path, stagedPath(filepath.Join(sectionDir, sigPath(name))), nil); checkErr != nil {
+			return fmt.Errorf("bad signature of database '%s': %w", name, checkErr)
+		}
+		defPrinter.info("Database '%s' signature is good.", name)
+	}
+	return nil
+}
+
+// checkPkgSignatures verifies every package and returns the sorted file names of the ones which are unsigned or badly signed.
+// Good signatures are cached, so unchanged packages are not read again.
+func checkPkgSignatures(keys openpgp.EntityList, sectionDir, stateDir string, pkgs []pkgDesc, verif *verifier, deep bool) ([]string, error) {
+	defPrinter.info("Checking package signatures...")
+	cache := loadSigCache(stateDir, keys, deep)
+	mut := sync.Mutex{}
+	bad := make(map[string]error)
+	queue := make(chan pkgDesc, len(pkgs))
+	for _, desc := range pkgs {
+		queue <- desc
+	}
+	close(queue)
+	workers := max(1, min(verif.jobs, uint(len(pkgs))))
+	errKeep := newErrKeeper(int(workers))
+	for w := uint(0); w < workers; w++ {
+		go func() {
+			defer errKeep.done()
+			for desc := range queue {
+				path := filepath.Join(sectionDir, desc.fileName)
+				checkErr := errors.New("not signed")
+				if isFileExist(sigPath(path)) {
+					if cache.isChecked(path) {
+						continue
+					}
+					checkErr = checkSignature(keys, path, sigPath(path), verif.limiter)
+				}
+				if checkErr == nil {
+					cache.record(path)
+				} else {
+					mut.Lock()
+					bad[desc.fileName] = checkErr
+					mut.Unlock()
+				}
+			}
+		}()
+	}
+	if checkErr := errKeep.get(); checkErr != nil {
+		return nil, checkErr
+	}
+	if saveErr := cache.save(pkgs); saveErr != nil {
+		defPrinter.error("Unable to save signature cache: %s.", saveErr)
+	}
+	if len(bad) == 0 {
+		defPrinter.line("Checking package signatures: OK.")
+		return nil, nil
+	}
+	names := make([]string, 0, len(bad))
+	for name := range bad {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		defPrinter.error("Package '%s' failed signature check: %s.", name, bad[name])
+	}
+	return names, nil
+}
+
+// skipRejectedPkgs leaves out the packages which failed the signature check before and are not changed upstream since,
+// so they are not fetched again; the names of the skipped ones are returned.
+func skipRejectedPkgs(pkgs []pkgDesc, rejected rejectedPkgs) ([]pkgDesc, []string) {
+	result := make([]pkgDesc, 0, len(pkgs))
+	skipped := make([]string, 0)
+	for _, desc := range pkgs {
+		if chksum, found := rejected.Chksums[desc.fileName]; found && chksum == desc.chksum {
+			defPrinter.error("Package '%s' failed signature check before, skipped.", desc.fileName)
+			skipped = append(skipped, desc.fileName)
+			continue
+		}
+		result = append(result, desc)
+	}
+	return result, skipped
+}
+
+// rejectPkgs leaves the badly signed packages out and records them along with the skipped ones,
+// unless the skipped ones were rejected by other keys: those are fetched and checked again next time.
+func rejectPkgs(pkgs []pkgDesc, bad, skipped []string, rejected rejectedPkgs, keys openpgp.EntityList) ([]pkgDesc, rejectedPkgs) {
+	result := rejectedPkgs{Keys: keysId(keys), Chksums: make(map[string]string)}
+	if rejected.Keys == result.Keys {
+		for _, name := range skipped {
+			result.Chksums[name] = rejected.Chksums[name]
+		}
+	}
+	kept := make([]pkgDesc, 0, len(pkgs))
+	for _, desc := range pkgs {
+		if slices.Contains(bad, desc.fileName) {
+			result.Chksums[desc.fileName] = desc.chksum
+			continue
+		}
+		kept = append(kept, desc)
+	}
+	return kept, result
+}
+
+// quarantinePkgs takes the rejected packages and their signatures out of the section, it must be done only
+// when the published databases don't list them anymore. They are kept in the quarantine directory if it is set.
+func quarantinePkgs(sectionDir, quarantineDir string, names []string) error {
+	if quarantineDir != "" {
+		if mkErr := os.MkdirAll(quarantineDir, 0755); mkErr != nil {
+			return mkErr
+		}
+	}
+	for _, name := range names {
+		for _, fileName := range []string{name, sigPath(name)} {
+			path := filepath.Join(sectionDir, fileName)
+			if !isFileExist(path) {
+				continue
+			}
+			var mvErr error
+			if quarantineDir == "" {
+				mvErr = os.Remove(path)
+			} else {
+				mvErr = moveFile(path, filepath.Join(quarantineDir, fileName))
+			}
+			if mvErr != nil {
+				return mvErr
+			}
+		}
+	}
+	return nil
+}
@@ -6,38 +6,71 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 )
 
-const sumChunkSize = 64 * 1048576
+// sumChunkSize is small as reads are throttled by 1 MiB anyway and every verify worker has its own buffer.
+const sumChunkSize = 1048576
 
+// pkgDesc holds a package record of the repository database.
 type pkgDesc struct {
-	name   string
-	chksum string
-	size   uint64
+	fileName     string
+	name         string
+	base         string
+	version      string
+	desc         string
+	groups       []string
+	size         uint64
+	instSize     uint64
+	md5sum       string
+	chksum       string
+	pgpSig       string
+	url          string
+	licenses     []string
+	arch         string
+	buildDate    int64
+	packager     string
+	replaces     []string
+	conflicts    []string
+	provides     []string
+	depends      []string
+	optDepends   []string
+	makeDepends  []string
+	checkDepends []string
+	// fields keeps every field as it is in the database, including unknown ones.
+	fields map[string][]string
 }
 
-func namesFromDescs(descs []pkgDesc) []string {
-	result := make([]string, 0, len(descs))
-	for _, desc := range descs {
-		result = append(result, desc.name)
-	}
-	return result
+type verifier struct {
+	cache   *chksumCache
+	limiter *rateLimiter
+	jobs    uint
 }
 
-func calcChkSum(path string) (string, error) {
+// hashFile feeds the file to the hasher through the buffer, a nil one is allocated for the call.
+func hashFile(hasher io.Writer, path string, limiter *rateLimiter, buf []byte) (int64, error) {
 	pkgFile, openErr := os.Open(path)
 	if openErr != nil {
-		return "", openErr
+		return 0, openErr
 	}
 	defer func() {
 		if closeErr := pkgFile.Close(); closeErr != nil {
 			panic(fmt.Sprintf("Unable calc chksum: %s.", path))
 		}
 	}()
-	buf := make([]byte, sumChunkSize)
+	if buf == nil {
+		buf = make([]byte, sumChunkSize)
+	}
+	var reader io.Reader = pkgFile
+	if limiter != nil {
+		reader = &throttledReader{reader: pkgFile, limiter: limiter}
+	}
+	return io.CopyBuffer(hasher, reader, buf)
+}
+
+func calcChkSum(path string, limiter *rateLimiter, buf []byte) (string, error) {
 	hasher := sha256.New()
-	copySize, copyErr := io.CopyBuffer(hasher, pkgFile, buf)
+	copySize, copyErr := hashFile(hasher, path, limiter, buf)
 	if copyErr != nil {
 		return "", copyErr
 	}
@@ -47,39 +80,73 @@ func calcChkSum(path string) (string, error) {
 	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 }
 
-func getPkgsToUpdate(sectionDir string, allPkgs []pkgDesc) ([]pkgDesc, error) {
-	total := len(allPkgs)
-	broken := 0
+// checkPackages sends packages which are missing or broken to the queue as soon as they are found.
+// Missing ones are found by a cheap lookup first, then the rest are hashed by a pool of workers.
+func checkPackages(sectionDir string, allPkgs []pkgDesc, verif *verifier, queue chan<- pkgDesc, sp *syncProgress) (int, int, error) {
 	missing := 0
-	prefix := "Checking packages"
-	message := ""
-	result := make([]pkgDesc, 0)
-	if !defPrinter.isVerbose() {
-		defPrinter.info("%s...", prefix)
+	existing := make([]pkgDesc, 0, len(allPkgs))
+	for _, desc := range allPkgs {
+		if isFileExist(filepath.Join(sectionDir, desc.fileName)) {
+			existing = append(existing, desc)
+			continue
+		}
+		missing++
+		sp.addQueued()
+		queue <- desc
+		sp.addChecked()
 	}
-	for idx, desc := range allPkgs {
-		message = fmt.Sprintf("\r%s: %d/%d", prefix, idx+1, total)
-		path := filepath.Join(sectionDir, desc.name)
-		if isFileExist(path) {
-			chksum, calcErr := calcChkSum(path)
-			if calcErr != nil {
-				return nil, calcErr
-			}
-			if chksum != desc.chksum {
-				broken++
-				result = append(result, desc)
+
+	jobs := make(chan pkgDesc, len(existing))
+	for _, desc := range existing {
+		jobs <- desc
+	}
+	close(jobs)
+
+	mut := sync.Mutex{}
+	broken := 0
+	workers := max(1, min(verif.jobs, uint(len(existing))))
+	errKeep := newErrKeeper(int(workers))
+	for w := uint(0); w < workers; w++ {
+		go func() {
+			defer errKeep.done()
+			buf := make([]byte, sumChunkSize)
+			for desc := range jobs {
+				chksum, calcErr := verif.cache.chksum(filepath.Join(sectionDir, desc.fileName), verif.limiter, buf)
+				if calcErr != nil {
+					errKeep.set(calcErr)
+					return
+				}
+				if chksum != desc.chksum {
+					mut.Lock()
+					broken++
+					mut.Unlock()
+					sp.addQueued()
+					queue <- desc
+				}
+				sp.addChecked()
 			}
-		} else {
-			missing++
-			result = append(result, desc)
+		}()
+	}
+	return missing, broken, errKeep.get()
+}
+
+// isSectionIntact makes a cheap check that every package of the published database is in place.
+func isSectionIntact(sectionDir, sectionName, dbArc string) bool {
+	for _, link := range []string{"db", "files"} {
+		if !isFileExist(filepath.Join(sectionDir, fmt.Sprintf("%s.%s", sectionName, link))) {
+			return false
 		}
-		defPrinter.progress(message)
 	}
-	defPrinter.progress("\r" + strings.Repeat(" ", len(message)) + "\r")
-	if broken == 0 && missing == 0 {
-		defPrinter.line("%s: OK.", prefix)
-	} else {
-		defPrinter.line("%s: %d missing, %d broken.", prefix, missing, broken)
+	pkgs, loadErr := loadDescFromDB(filepath.Join(sectionDir, dbArc))
+	if loadErr != nil {
+		defPrinter.error("Unable to load published DB: %s.", loadErr)
+		return false
+	}
+	for _, desc := range pkgs {
+		size, sizeErr := fileSize(filepath.Join(sectionDir, desc.fileName))
+		if sizeErr != nil || size != int64(desc.size) {
+			return false
+		}
 	}
-	return result, nil
+	return true
 }
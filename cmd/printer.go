@@ -3,39 +3,98 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 )
 
 type printer struct {
+	mut          sync.Mutex
 	showProgress bool
+	silent       bool
+	status       string
 }
 
 func (p *printer) setQuiet() {
 	p.showProgress = false
 }
 
+// setSilent leaves only errors, so stdout carries nothing but the result.
+func (p *printer) setSilent() {
+	p.showProgress = false
+	p.silent = true
+}
+
+func (p *printer) write(value string) {
+	if _, writeErr := os.Stdout.WriteString(value); writeErr != nil {
+		panic(writeErr)
+	}
+}
+
+// hideStatus wipes the status line, so other output doesn't mix with it.
+func (p *printer) hideStatus() {
+	if p.showProgress && p.status != "" {
+		p.write("\r" + strings.Repeat(" ", len(p.status)) + "\r")
+	}
+}
+
+func (p *printer) showStatus() {
+	if p.showProgress && p.status != "" {
+		p.write(p.status)
+	}
+}
+
 func (p *printer) line(format string, args ...any) {
+	defer p.mut.Unlock()
+	p.mut.Lock()
+	if p.silent {
+		return
+	}
+	p.hideStatus()
 	fmt.Printf(format+"\n", args...)
+	p.showStatus()
 }
 
 func (p *printer) info(format string, args ...any) {
+	defer p.mut.Unlock()
+	p.mut.Lock()
+	if p.silent {
+		return
+	}
+	p.hideStatus()
 	fmt.Printf(">>> "+format+"\n", args...)
+	p.showStatus()
 }
 
 func (p *printer) error(format string, args ...any) {
+	defer p.mut.Unlock()
+	p.mut.Lock()
+	p.hideStatus()
 	if _, writeErr := fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", args...); writeErr != nil {
 		panic(writeErr)
 	}
+	p.showStatus()
 }
 
 func (p *printer) progress(value string) {
+	defer p.mut.Unlock()
+	p.mut.Lock()
 	if p.showProgress {
-		if _, writeErr := os.Stdout.WriteString(value); writeErr != nil {
-			panic(writeErr)
-		}
+		p.write(value)
 	}
 }
 
+// setStatus shows the line which stays below any other output until it is reset by an empty value.
+func (p *printer) setStatus(value string) {
+	defer p.mut.Unlock()
+	p.mut.Lock()
+	p.hideStatus()
+	p.status = value
+	p.showStatus()
+}
+
 func (p *printer) eol() {
+	defer p.mut.Unlock()
+	p.mut.Lock()
 	fmt.Println()
 }
 
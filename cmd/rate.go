@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const throttleChunkSize = 1048576
+
+// rateLimiter spreads reads of all its users in time, so they don't exceed the rate together.
+type rateLimiter struct {
+	mut  sync.Mutex
+	rate float64
+	next time.Time
+}
+
+// newRateLimiter returns a limiter for the rate in MB/s or nil which means no limit.
+func newRateLimiter(rate uint) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate) * 1048576}
+}
+
+func (l *rateLimiter) wait(size int) {
+	if l == nil || size <= 0 {
+		return
+	}
+	l.mut.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	until := l.next
+	l.next = l.next.Add(time.Duration(float64(size) / l.rate * float64(time.Second)))
+	l.mut.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+type throttledReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(buf []byte) (int, error) {
+	if len(buf) > throttleChunkSize {
+		buf = buf[:throttleChunkSize]
+	}
+	readSize, readErr := t.reader.Read(buf)
+	t.limiter.wait(readSize)
+	return readSize, readErr
+}
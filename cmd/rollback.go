@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// parseTarget splits '<arch>[/<section>]', an empty section means all the sections of the arch.
+func parseTarget(target string) (string, string, error) {
+	arch, section, _ := strings.Cut(strings.Trim(target, "/"), "/")
+	if arch == "" || strings.Contains(section, "/") {
+		return "", "", fmt.Errorf("invalid target '%s', expected '<arch>' or '<arch>/<section>'", target)
+	}
+	return arch, section, nil
+}
+
+// targetSections returns the sections of the target found in the directory.
+func targetSections(baseDir, arch, section string) ([]string, error) {
+	if section != "" {
+		return []string{section}, nil
+	}
+	entries, lookErr := os.ReadDir(filepath.Join(baseDir, arch))
+	if lookErr != nil {
+		return nil, lookErr
+	}
+	result := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && !isTransientFile(entry.Name()) {
+			result = append(result, entry.Name())
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no sections of '%s' found in '%s'", arch, baseDir)
+	}
+	return result, nil
+}
+
+// snapshotDbExt returns the extension of the databases in the directory by the '<section>.db' symlink.
+func snapshotDbExt(dir, sectionName string) (string, error) {
+	linkName := fmt.Sprintf("%s.db", sectionName)
+	info, infoErr := os.Lstat(filepath.Join(dir, linkName))
+	if infoErr != nil {
+		return "", infoErr
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", nil
+	}
+	target, linkErr := os.Readlink(filepath.Join(dir, linkName))
+	if linkErr != nil {
+		return "", linkErr
+	}
+	return strings.TrimPrefix(target, linkName+"."), nil
+}
+
+// restorePackages puts back every package the snapshot lists, the ones which are gone from the live tree
+// are hardlinked from the snapshot.
+func restorePackages(snapDir, sectionDir string, pkgs []pkgDesc) error {
+	restored := 0
+	for _, desc := range pkgs {
+		for _, name := range []string{desc.fileName, sigPath(desc.fileName)} {
+			livePath := filepath.Join(sectionDir, name)
+			snapPath := filepath.Join(snapDir, name)
+			if isFileExist(livePath) {
+				continue
+			}
+			if !isFileExist(snapPath) {
+				if name != desc.fileName {
+					continue // The package is not signed.
+				}
+				return fmt.Errorf("package '%s' is missing both in the snapshot and in the section", name)
+			}
+			if linkErr := os.Link(snapPath, livePath); linkErr != nil {
+				if copyErr := copyFile(snapPath, livePath); copyErr != nil {
+					return copyErr
+				}
+			}
+			restored++
+		}
+	}
+	if restored > 0 {
+		defPrinter.info("%d file(s) restored from the snapshot.", restored)
+	}
+	return nil
+}
+
+// rollbackSection republishes the section databases from the snapshot and pins the section to it.
+// Databases are staged first and swapped by renames, so clients never see a partial state.
+func rollbackSection(rootDir, day, arch, sectionName string) error {
+	snapDir := filepath.Join(snapshotsDir(rootDir), day, arch, sectionName)
+	sectionDir := filepath.Join(rootDir, arch, sectionName)
+	defPrinter.info("Rolling '%s/%s' back to snapshot '%s'...", arch, sectionName, day)
+
+	ext, extErr := snapshotDbExt(snapDir, sectionName)
+	if extErr != nil {
+		return extErr
+	}
+	dbFiles := []string{dbFileName(sectionName, "files", ext), dbFileName(sectionName, "db", ext)}
+	pkgs, loadErr := loadDescFromDB(filepath.Join(snapDir, dbFiles[1]))
+	if loadErr != nil {
+		return loadErr
+	}
+	if mkdirErr := os.MkdirAll(sectionDir, 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	if restoreErr := restorePackages(snapDir, sectionDir, pkgs); restoreErr != nil {
+		return restoreErr
+	}
+
+	for _, name := range dbFiles {
+		for _, fileName := range []string{name, sigPath(name)} {
+			snapPath := filepath.Join(snapDir, fileName)
+			if fileName != name && !isFileExist(snapPath) {
+				continue
+			}
+			if copyErr := copyFile(snapPath, stagedPath(filepath.Join(sectionDir, fileName))); copyErr != nil {
+				return copyErr
+			}
+		}
+	}
+	if pubErr := publishFiles(sectionDir, dbFiles); pubErr != nil {
+		return pubErr
+	}
+	if linkErr := fixupSymlinks(sectionDir, sectionName, ext); linkErr != nil {
+		return linkErr
+	}
+
+	stateDir := sectionStateDir(rootDir, arch, sectionName)
+	// The next sync after unpinning has to fetch the databases again.
+	if saveErr := saveValidator(stateDir, dbValidator{}); saveErr != nil {
+		return saveErr
+	}
+	if saveErr := savePublishedState(stateDir, publishedState{NewestBuildDate: newestBuildDate(pkgs)}); saveErr != nil {
+		return saveErr
+	}
+	if pinErr := savePin(stateDir, sectionPin{Snapshot: day, Since: time.Now()}); pinErr != nil {
+		return pinErr
+	}
+	defPrinter.info("Section '%s/%s' is rolled back and pinned to snapshot '%s'.", arch, sectionName, day)
+	return nil
+}
+
+func rollbackTarget(rootDir, day, target string) error {
+	parsed, parseErr := time.Parse(snapshotDayLayout, day)
+	if parseErr != nil {
+		return fmt.Errorf("invalid snapshot '%s', expected YYYY/MM/DD", day)
+	}
+	day = parsed.Format(snapshotDayLayout)
+	arch, section, targetErr := parseTarget(target)
+	if targetErr != nil {
+		return targetErr
+	}
+	sections, lookErr := targetSections(filepath.Join(snapshotsDir(rootDir), day), arch, section)
+	if lookErr != nil {
+		return lookErr
+	}
+	for _, sectionName := range sections {
+		if rollbackErr := rollbackSection(rootDir, day, arch, sectionName); rollbackErr != nil {
+			return rollbackErr
+		}
+	}
+	return nil
+}
+
+func unpinTarget(rootDir, target string) error {
+	arch, section, targetErr := parseTarget(target)
+	if targetErr != nil {
+		return targetErr
+	}
+	sections, lookErr := targetSections(filepath.Join(rootDir, stateDirName), arch, section)
+	if lookErr != nil {
+		return lookErr
+	}
+	for _, sectionName := range sections {
+		stateDir := sectionStateDir(rootDir, arch, sectionName)
+		pin := loadPin(stateDir)
+		if pin.Snapshot == "" {
+			defPrinter.info("Section '%s/%s' is not pinned.", arch, sectionName)
+			continue
+		}
+		if rmErr := removePin(stateDir); rmErr != nil {
+			return rmErr
+		}
+		defPrinter.info("Section '%s/%s' is unpinned from snapshot '%s'.", arch, sectionName, pin.Snapshot)
+	}
+	return nil
+}
+
+// pinnedSnapshots returns the snapshots sections are pinned to, they are kept regardless of the retention.
+func pinnedSnapshots(rootDir string) map[string]struct{} {
+	result := make(map[string]struct{})
+	matches, globErr := filepath.Glob(filepath.Join(rootDir, stateDirName, "*", "*"))
+	if globErr != nil {
+		return result
+	}
+	for _, stateDir := range matches {
+		if pin := loadPin(stateDir); pin.Snapshot != "" {
+			result[pin.Snapshot] = struct{}{}
+		}
+	}
+	return result
+}
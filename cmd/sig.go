@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const sigSuffix = ".sig"
+
+func sigPath(path string) string {
+	return path + sigSuffix
+}
+
+// writeEmbeddedSig stores the signature taken from the DB next to the package unless it is already there.
+func writeEmbeddedSig(path, pgpSig string) (bool, error) {
+	sig, decodeErr := base64.StdEncoding.DecodeString(pgpSig)
+	if decodeErr != nil {
+		return false, fmt.Errorf("invalid embedded signature of '%s': %w", filepath.Base(path), decodeErr)
+	}
+	existing, readErr := os.ReadFile(sigPath(path))
+	if readErr == nil && bytes.Equal(existing, sig) {
+		return false, nil
+	}
+	if writeErr := os.WriteFile(stagedPath(sigPath(path)), sig, 0644); writeErr != nil {
+		return false, writeErr
+	}
+	return true, os.Rename(stagedPath(sigPath(path)), sigPath(path))
+}
+
+// fetchSignature downloads the signature of the file from the first upstream having it,
+// errNotFound means that no upstream has it, i.e. the file is not signed.
+func fetchSignature(ups []*upstream, path, name string, idx, amount uint) error {
+	var lastErr error = nil
+	for _, up := range ups {
+		pb := newProgressBar(idx, amount, name+sigSuffix, urlHost(up.baseUrl), false)
+		lastErr = downloadFile(up.fileUrl(name+sigSuffix), sigPath(path), "", 1, pb)
+		if lastErr == nil {
+			up.countServed(1)
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// syncSignatures puts a signature next to every package, it is taken from the DB if embedded there
+// or fetched from upstream otherwise.
+func syncSignatures(ups []*upstream, sectionDir string, pkgs []pkgDesc, jobs uint) error {
+	mut := sync.Mutex{}
+	written, fetched, unsigned := 0, 0, 0
+	count := func(counter *int) {
+		mut.Lock()
+		*counter++
+		mut.Unlock()
+	}
+
+	missing := make([]pkgDesc, 0)
+	for _, desc := range pkgs {
+		path := filepath.Join(sectionDir, desc.fileName)
+		if desc.pgpSig != "" {
+			changed, writeErr := writeEmbeddedSig(path, desc.pgpSig)
+			if writeErr != nil {
+				return writeErr
+			}
+			if changed {
+				count(&written)
+			}
+		} else if !isFileExist(sigPath(path)) {
+			missing = append(missing, desc)
+		}
+	}
+
+	queue := make(chan int, len(missing))
+	for idx := range missing {
+		queue <- idx
+	}
+	close(queue)
+	amount := uint(len(missing))
+	workers := max(1, min(jobs, amount))
+	errKeep := newErrKeeper(int(workers))
+	for w := uint(0); w < workers; w++ {
+		go func() {
+			defer errKeep.done()
+			for idx := range queue {
+				desc := missing[idx]
+				path := filepath.Join(sectionDir, desc.fileName)
+				fetchErr := fetchSignature(ups, path, desc.fileName, uint(idx+1), amount)
+				switch {
+				case fetchErr == nil:
+					count(&fetched)
+				case errors.Is(fetchErr, errNotFound):
+					count(&unsigned)
+				default:
+					defPrinter.error("Unable to fetch signature of '%s': %s.", desc.fileName, fetchErr)
+					errKeep.set(fetchErr)
+				}
+			}
+		}()
+	}
+	if sigErr := errKeep.get(); sigErr != nil {
+		return sigErr
+	}
+	if written+fetched+unsigned > 0 {
+		defPrinter.info("Signatures: %d taken from DB, %d fetched, %d package(s) unsigned.", written, fetched, unsigned)
+	}
+	return nil
+}
+
+// stageSignatures fetches signatures of the databases from the upstream that served them, if it has any.
+func stageSignatures(up *upstream, sectionDir string, names []string, threads uint) error {
+	amount := uint(len(names))
+	for i, name := range names {
+		path := stagedPath(filepath.Join(sectionDir, name+sigSuffix))
+		pb := newProgressBar(uint(i+1), amount, name+sigSuffix, urlHost(up.baseUrl), true)
+		downErr := downloadFile(up.fileUrl(name+sigSuffix), path, "", threads, pb)
+		if downErr == nil {
+			up.countServed(1)
+			continue
+		}
+		if !errors.Is(downErr, errNotFound) {
+			return downErr
+		}
+		if rmErr := rmFile(path); rmErr != nil {
+			return rmErr
+		}
+	}
+	return nil
+}
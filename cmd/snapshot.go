@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotsDirName  = "snapshots"
+	snapshotDayLayout = "2006/01/02"
+)
+
+// snapshotPolicy tells how many days, weeks and months snapshots are kept for,
+// only the newest snapshot of a week or a month is kept; all zeroes keep everything.
+type snapshotPolicy struct {
+	daily   int
+	weekly  int
+	monthly int
+}
+
+func snapshotsDir(rootDir string) string {
+	return filepath.Join(rootDir, snapshotsDirName)
+}
+
+func snapshotSectionDir(rootDir string, day time.Time, arch, sectionName string) string {
+	return filepath.Join(snapshotsDir(rootDir), day.Format(snapshotDayLayout), arch, sectionName)
+}
+
+func copyFile(srcPath, dstPath string) error {
+	srcFile, openErr := os.Open(srcPath)
+	if openErr != nil {
+		return openErr
+	}
+	defer func() {
+		if closeErr := srcFile.Close(); closeErr != nil {
+			defPrinter.error("Unable to close '%s': %s.", srcPath, closeErr)
+		}
+	}()
+	dstFile, createErr := os.Create(dstPath)
+	if createErr != nil {
+		return createErr
+	}
+	_, copyErr := io.Copy(dstFile, srcFile)
+	if closeErr := dstFile.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	return copyErr
+}
+
+// isTransientFile tells whether the file is a download or publishing leftover.
+func isTransientFile(name string) bool {
+	for _, suffix := range []string{stagedSuffix, partSuffix, stateSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneSection fills the directory with the section files: packages are hardlinked,
+// so they take no space, databases are copied, as they are replaced in place on sync, and symlinks are recreated.
+func cloneSection(sectionDir, dstDir string) error {
+	if mkdirErr := os.MkdirAll(dstDir, 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	entries, lookErr := os.ReadDir(sectionDir)
+	if lookErr != nil {
+		return lookErr
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		srcPath := filepath.Join(sectionDir, name)
+		dstPath := filepath.Join(dstDir, name)
+		switch {
+		case isTransientFile(name):
+			continue
+		case entry.Type()&os.ModeSymlink != 0:
+			target, linkErr := os.Readlink(srcPath)
+			if linkErr != nil {
+				return linkErr
+			}
+			if linkErr = os.Symlink(target, dstPath); linkErr != nil {
+				return linkErr
+			}
+		case !entry.Type().IsRegular():
+			continue
+		case isPkgFile(name):
+			if linkErr := os.Link(srcPath, dstPath); linkErr != nil {
+				// Hardlinks don't cross filesystems, the copy is the only way then.
+				if copyErr := copyFile(srcPath, dstPath); copyErr != nil {
+					return copyErr
+				}
+			}
+		default:
+			if copyErr := copyFile(srcPath, dstPath); copyErr != nil {
+				return copyErr
+			}
+		}
+	}
+	return nil
+}
+
+// takeSnapshot saves the section state of the day, a later sync of the same day replaces it.
+func takeSnapshot(rootDir, arch, sectionName string, now time.Time) error {
+	sectionDir := filepath.Join(rootDir, arch, sectionName)
+	snapDir := snapshotSectionDir(rootDir, now, arch, sectionName)
+	if rmErr := os.RemoveAll(stagedPath(snapDir)); rmErr != nil {
+		return rmErr
+	}
+	if cloneErr := cloneSection(sectionDir, stagedPath(snapDir)); cloneErr != nil {
+		return cloneErr
+	}
+	oldDir := snapDir + ".old"
+	if _, statErr := os.Stat(snapDir); statErr == nil {
+		if renameErr := os.Rename(snapDir, oldDir); renameErr != nil {
+			return renameErr
+		}
+	}
+	if renameErr := os.Rename(stagedPath(snapDir), snapDir); renameErr != nil {
+		return renameErr
+	}
+	if rmErr := os.RemoveAll(oldDir); rmErr != nil {
+		return rmErr
+	}
+	defPrinter.info("Snapshot '%s' saved.", now.Format(snapshotDayLayout))
+	return nil
+}
+
+// isSnapshotTaken tells whether the section has the snapshot of the day.
+func isSnapshotTaken(rootDir, arch, sectionName string, now time.Time) bool {
+	info, statErr := os.Stat(snapshotSectionDir(rootDir, now, arch, sectionName))
+	return statErr == nil && info.IsDir()
+}
+
+// listSnapshots returns the days snapshots are taken on, newest first.
+func listSnapshots(rootDir string) ([]time.Time, error) {
+	matches, globErr := filepath.Glob(filepath.Join(snapshotsDir(rootDir), "[0-9]*", "[0-9]*", "[0-9]*"))
+	if globErr != nil {
+		return nil, globErr
+	}
+	result := make([]time.Time, 0, len(matches))
+	for _, path := range matches {
+		rel, relErr := filepath.Rel(snapshotsDir(rootDir), path)
+		if relErr != nil {
+			return nil, relErr
+		}
+		day, parseErr := time.ParseInLocation(snapshotDayLayout, filepath.ToSlash(rel), time.Local)
+		if parseErr != nil {
+			defPrinter.error("Unexpected snapshot directory '%s'.", path)
+			continue
+		}
+		result = append(result, day)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].After(result[j])
+	})
+	return result, nil
+}
+
+func monthIndex(day time.Time) int {
+	return day.Year()*12 + int(day.Month()) - 1
+}
+
+// keptSnapshots returns the days which the policy keeps snapshots of, the days must be sorted newest first.
+func (p *snapshotPolicy) keptSnapshots(days []time.Time, now time.Time) map[time.Time]struct{} {
+	result := make(map[time.Time]struct{}, len(days))
+	if p.daily == 0 && p.weekly == 0 && p.monthly == 0 {
+		for _, day := range days {
+			result[day] = struct{}{}
+		}
+		return result
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	seenWeeks := make(map[string]struct{})
+	seenMonths := make(map[int]struct{})
+	for _, day := range days {
+		daysAgo := int(today.Sub(day).Hours() / 24)
+		year, week := day.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+		_, weekSeen := seenWeeks[weekKey]
+		_, monthSeen := seenMonths[monthIndex(day)]
+		switch {
+		case daysAgo < p.daily:
+		case !weekSeen && daysAgo/7 < p.weekly:
+		case !monthSeen && monthIndex(today)-monthIndex(day) < p.monthly:
+		default:
+			continue
+		}
+		result[day] = struct{}{}
+		seenWeeks[weekKey] = struct{}{}
+		seenMonths[monthIndex(day)] = struct{}{}
+	}
+	return result
+}
+
+// pruneSnapshots removes the snapshots the policy doesn't keep, along with the emptied month and year directories.
+func pruneSnapshots(rootDir string, policy *snapshotPolicy, now time.Time) error {
+	days, listErr := listSnapshots(rootDir)
+	if listErr != nil {
+		return listErr
+	}
+	kept := policy.keptSnapshots(days, now)
+	pinned := pinnedSnapshots(rootDir)
+	for _, day := range days {
+		if _, found := kept[day]; found {
+			continue
+		}
+		if _, found := pinned[day.Format(snapshotDayLayout)]; found {
+			continue
+		}
+		dayDir := filepath.Join(snapshotsDir(rootDir), day.Format(snapshotDayLayout))
+		if rmErr := os.RemoveAll(dayDir); rmErr != nil {
+			return rmErr
+		}
+		defPrinter.info("Snapshot '%s' removed.", day.Format(snapshotDayLayout))
+		// Removing a non-empty directory fails, which is fine.
+		monthDir := filepath.Dir(dayDir)
+		if os.Remove(monthDir) == nil {
+			_ = os.Remove(filepath.Dir(monthDir))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/BurntSushi/toml"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const stateDirName = ".amt"
+
+type dbValidator struct {
+	Url          string `toml:"url"`
+	ETag         string `toml:"etag"`
+	LastModified string `toml:"last_modified"`
+}
+
+// publishedState describes the databases which are published now.
+type publishedState struct {
+	NewestBuildDate int64 `toml:"newest_build_date"`
+	// Filter is the rules the databases are filtered by, empty if they are published as is.
+	Filter string `toml:"filter"`
+}
+
+// sectionPin holds the section at the snapshot it was rolled back to.
+type sectionPin struct {
+	Snapshot string    `toml:"snapshot"`
+	Since    time.Time `toml:"since"`
+}
+
+// atticEntries records when the packages entered the attic, a move keeps the download time of the file.
+type atticEntries struct {
+	Entered map[string]time.Time `toml:"entered"`
+}
+
+// rejectedPkgs records the checksums of the packages which failed the signature check with the keys,
+// they are not fetched again while upstream keeps them the same.
+type rejectedPkgs struct {
+	Keys    string            `toml:"keys"`
+	Chksums map[string]string `toml:"chksums"`
+}
+
+// sectionStateDir returns the directory for amt's own files, it is kept out of the published section tree.
+func sectionStateDir(rootDir, arch, sectionName string) string {
+	return filepath.Join(rootDir, stateDirName, arch, sectionName)
+}
+
+func loadState(stateDir, name string, value any) {
+	if _, decodeErr := toml.DecodeFile(filepath.Join(stateDir, name), value); decodeErr != nil {
+		if !os.IsNotExist(decodeErr) {
+			defPrinter.error("Unable to load state '%s': %s.", name, decodeErr)
+		}
+	}
+}
+
+func saveState(stateDir, name string, value any) error {
+	if mkdirErr := os.MkdirAll(stateDir, 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	path := filepath.Join(stateDir, name)
+	stateFile, openErr := os.Create(stagedPath(path))
+	if openErr != nil {
+		return openErr
+	}
+	encodeErr := toml.NewEncoder(stateFile).Encode(value)
+	if closeErr := stateFile.Close(); encodeErr == nil {
+		encodeErr = closeErr
+	}
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return os.Rename(stagedPath(path), path)
+}
+
+func loadValidator(stateDir string) dbValidator {
+	var result dbValidator
+	loadState(stateDir, "validator.toml", &result)
+	return result
+}
+
+func saveValidator(stateDir string, validator dbValidator) error {
+	return saveState(stateDir, "validator.toml", validator)
+}
+
+func loadPublishedState(stateDir string) publishedState {
+	var result publishedState
+	loadState(stateDir, "published.toml", &result)
+	return result
+}
+
+func savePublishedState(stateDir string, state publishedState) error {
+	return saveState(stateDir, "published.toml", state)
+}
+
+func loadAtticEntries(stateDir string) atticEntries {
+	result := atticEntries{Entered: make(map[string]time.Time)}
+	loadState(stateDir, "attic.toml", &result)
+	return result
+}
+
+func saveAtticEntries(stateDir string, entries atticEntries) error {
+	return saveState(stateDir, "attic.toml", entries)
+}
+
+func loadRejectedPkgs(stateDir string) rejectedPkgs {
+	result := rejectedPkgs{Chksums: make(map[string]string)}
+	loadState(stateDir, "rejected.toml", &result)
+	return result
+}
+
+func saveRejectedPkgs(stateDir string, rejected rejectedPkgs) error {
+	return saveState(stateDir, "rejected.toml", rejected)
+}
+
+func loadPin(stateDir string) sectionPin {
+	var result sectionPin
+	loadState(stateDir, "pin.toml", &result)
+	return result
+}
+
+func savePin(stateDir string, pin sectionPin) error {
+	return saveState(stateDir, "pin.toml", pin)
+}
+
+func removePin(stateDir string) error {
+	return rmFile(filepath.Join(stateDir, "pin.toml"))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	keyringsDir    = "usr/share/pacman/keyrings/"
+	maxKeyringSize = 64 * 1048576
+)
+
+// keyTrust builds the keyring of the mirror from its own keyring package,
+// the package is trusted only if it is signed by a pinned master key or by a key certified by one.
+type keyTrust struct {
+	pkgName string
+	section string
+	masters map[string]struct{}
+	keys    openpgp.EntityList
+}
+
+func newKeyTrust(pkgName, section string, masterKeys []string) (*keyTrust, error) {
+	if len(masterKeys) == 0 {
+		return nil, fmt.Errorf("no master key fingerprints pinned for '%s'", pkgName)
+	}
+	masters := make(map[string]struct{}, len(masterKeys))
+	for _, fpr := range masterKeys {
+		masters[normFingerprint(fpr)] = struct{}{}
+	}
+	return &keyTrust{pkgName: pkgName, section: section, masters: masters}, nil
+}
+
+func normFingerprint(fpr string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(strings.TrimSpace(fpr), "0x"), " ", ""))
+}
+
+func keyFingerprint(entity *openpgp.Entity) string {
+	return fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+}
+
+// readKeyringPkg returns the keys and the revoked fingerprints shipped in the keyring package.
+func readKeyringPkg(path string) (openpgp.EntityList, map[string]struct{}, error) {
+	pkgFile, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, nil, openErr
+	}
+	defer func() {
+		if closeErr := pkgFile.Close(); closeErr != nil {
+			defPrinter.error("Unable close keyring package: %s.", closeErr)
+		}
+	}()
+	tarReader, release, arcErr := openArchive(bufio.NewReaderSize(pkgFile, fileChunkSize))
+	if arcErr != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filepath.Base(path), arcErr)
+	}
+	defer release()
+
+	keys := make(openpgp.EntityList, 0)
+	revoked := make(map[string]struct{})
+	pkgTar := tar.NewReader(tarReader)
+	for {
+		header, tarErr := pkgTar.Next()
+		if tarErr != nil {
+			if tarErr == io.EOF {
+				break
+			}
+			return nil, nil, tarErr
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if header.Typeflag != tar.TypeReg || !strings.HasPrefix(name, keyringsDir) {
+			continue
+		}
+		if header.Size > maxKeyringSize {
+			return nil, nil, fmt.Errorf("'%s' is too large: %d bytes", name, header.Size)
+		}
+		content, readErr := io.ReadAll(pkgTar)
+		if readErr != nil {
+			return nil, nil, readErr
+		}
+		switch {
+		case strings.HasSuffix(name, ".gpg"):
+			entities, keysErr := parseKeys(content)
+			if keysErr != nil {
+				return nil, nil, fmt.Errorf("%s: %w", name, keysErr)
+			}
+			keys = append(keys, entities...)
+		case strings.HasSuffix(name, "-revoked"):
+			for _, line := range strings.Split(string(content), "\n") {
+				if fpr := normFingerprint(line); fpr != "" {
+					revoked[fpr] = struct{}{}
+				}
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("no keys found in '%s'", filepath.Base(path))
+	}
+	return keys, revoked, nil
+}
+
+// isCertified tells whether any user ID of the entity is certified by one of the master keys.
+// A certification is void if the same master revoked it at the same time or later.
+func isCertified(entity *openpgp.Entity, masters openpgp.EntityList) bool {
+	for _, identity := range entity.Identities {
+		for _, master := range masters {
+			var certified, revoked time.Time
+			for _, sig := range identity.Signatures {
+				if !sig.CheckKeyIdOrFingerprint(master.PrimaryKey) {
+					continue
+				}
+				if master.PrimaryKey.VerifyUserIdSignature(identity.Name, entity.PrimaryKey, sig) != nil {
+					continue
+				}
+				if sig.SigType == packet.SigTypeCertificationRevocation {
+					if sig.CreationTime.After(revoked) {
+						revoked = sig.CreationTime
+					}
+				} else if sig.CreationTime.After(certified) {
+					certified = sig.CreationTime
+				}
+			}
+			if !certified.IsZero() && certified.After(revoked) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bootstrap verifies the keyring package found among the section packages
+// and takes the master keys and the keys they certified, except the revoked ones.
+func (t *keyTrust) bootstrap(sectionDir string, pkgs []pkgDesc, limiter *rateLimiter) error {
+	var keyringPkg *pkgDesc
+	for i := range pkgs {
+		if pkgs[i].name == t.pkgName {
+			keyringPkg = &pkgs[i]
+			break
+		}
+	}
+	if keyringPkg == nil {
+		return fmt.Errorf("keyring package '%s' not found in section '%s'", t.pkgName, t.section)
+	}
+	path := filepath.Join(sectionDir, keyringPkg.fileName)
+	keys, revoked, readErr := readKeyringPkg(path)
+	if readErr != nil {
+		return readErr
+	}
+
+	now := time.Now()
+	masters := make(openpgp.EntityList, 0, len(t.masters))
+	for _, entity := range keys {
+		fpr := keyFingerprint(entity)
+		if _, found := t.masters[fpr]; !found {
+			continue
+		}
+		if _, found := revoked[fpr]; found || entity.Revoked(now) {
+			defPrinter.error("Pinned master key %s is revoked.", fpr)
+			continue
+		}
+		masters = append(masters, entity)
+	}
+	if len(masters) == 0 {
+		return fmt.Errorf("none of the pinned master keys found in '%s'", keyringPkg.fileName)
+	}
+
+	trusted := make(openpgp.EntityList, 0, len(keys))
+	trusted = append(trusted, masters...)
+	for _, entity := range keys {
+		fpr := keyFingerprint(entity)
+		if _, found := t.masters[fpr]; found {
+			continue
+		}
+		if _, found := revoked[fpr]; found || entity.Revoked(now) {
+			continue
+		}
+		if isCertified(entity, masters) {
+			trusted = append(trusted, entity)
+		}
+	}
+
+	if !isFileExist(sigPath(path)) {
+		return fmt.Errorf("keyring package '%s' is not signed", keyringPkg.fileName)
+	}
+	if checkErr := checkSignature(trusted, path, sigPath(path), limiter); checkErr != nil {
+		return fmt.Errorf("bad signature of keyring package '%s': %w", keyringPkg.fileName, checkErr)
+	}
+	defPrinter.info("Trusting %d key(s) from '%s', %d of them are master ones.", len(trusted), keyringPkg.fileName, len(masters))
+	t.keys = trusted
+	return nil
+}
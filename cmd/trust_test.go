@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"testing"
+	"time"
+)
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+	entity, newErr := openpgp.NewEntity(name, "", name+"@example.org", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	return entity
+}
+
+// certify adds the certification, or its revocation, of every user ID of the entity made by the master at the time.
+func certify(t *testing.T, entity, master *openpgp.Entity, sigType packet.SignatureType, at time.Time) {
+	t.Helper()
+	for _, identity := range entity.Identities {
+		sig := &packet.Signature{
+			Version:           master.PrimaryKey.Version,
+			SigType:           sigType,
+			PubKeyAlgo:        master.PrimaryKey.PubKeyAlgo,
+			Hash:              crypto.SHA256,
+			CreationTime:      at,
+			IssuerKeyId:       &master.PrimaryKey.KeyId,
+			IssuerFingerprint: master.PrimaryKey.Fingerprint,
+		}
+		if signErr := sig.SignUserId(identity.Name, entity.PrimaryKey, master.PrivateKey, nil); signErr != nil {
+			t.Fatal(signErr)
+		}
+		identity.Signatures = append(identity.Signatures, sig)
+	}
+}
+
+func TestIsCertified(t *testing.T) {
+	master := newTestEntity(t, "master")
+	other := newTestEntity(t, "other")
+	masters := openpgp.EntityList{master}
+	day := time.Now().Add(-72 * time.Hour).Truncate(time.Second)
+
+	packager := newTestEntity(t, "packager")
+	if isCertified(packager, masters) {
+		t.Error("key without certifications is certified")
+	}
+	certify(t, packager, other, packet.SigTypeGenericCert, day)
+	if isCertified(packager, masters) {
+		t.Error("key certified by a non-master is certified")
+	}
+	certify(t, packager, master, packet.SigTypeGenericCert, day)
+	if !isCertified(packager, masters) {
+		t.Error("key certified by the master is not certified")
+	}
+	certify(t, packager, other, packet.SigTypeCertificationRevocation, day.Add(time.Hour))
+	if !isCertified(packager, masters) {
+		t.Error("revocation by a non-master voids the certification")
+	}
+	certify(t, packager, master, packet.SigTypeCertificationRevocation, day.Add(time.Hour))
+	if isCertified(packager, masters) {
+		t.Error("certification revoked by the master is still accepted")
+	}
+	certify(t, packager, master, packet.SigTypeGenericCert, day.Add(2*time.Hour))
+	if !isCertified(packager, masters) {
+		t.Error("key certified again after the revocation is not certified")
+	}
+}
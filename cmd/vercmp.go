@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || isAlpha(c)
+}
+
+// rpmvercmp compares version segments the way alpm does: digits and letters form alternating segments,
+// numbers are compared as numbers and beat letters, a longer separator wins, and a trailing letter segment
+// loses to nothing, so '1.0rc' < '1.0' < '1.0.1'.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	one, two := 0, 0
+	// Once either string is used up, what is left of the other one decides the order.
+	for one < len(a) && two < len(b) {
+		sepOne, sepTwo := one, two
+		for one < len(a) && !isAlnum(a[one]) {
+			one++
+		}
+		for two < len(b) && !isAlnum(b[two]) {
+			two++
+		}
+		if one >= len(a) || two >= len(b) {
+			break
+		}
+		// Separators of different lengths decide the order on their own.
+		if one-sepOne != two-sepTwo {
+			if one-sepOne < two-sepTwo {
+				return -1
+			}
+			return 1
+		}
+
+		endOne, endTwo := one, two
+		isNum := isDigit(a[one])
+		segmentChar := isAlpha
+		if isNum {
+			segmentChar = isDigit
+		}
+		for endOne < len(a) && segmentChar(a[endOne]) {
+			endOne++
+		}
+		for endTwo < len(b) && segmentChar(b[endTwo]) {
+			endTwo++
+		}
+		// Segments of different types: a number is newer than letters.
+		if endTwo == two {
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+
+		segOne, segTwo := a[one:endOne], b[two:endTwo]
+		if isNum {
+			segOne = strings.TrimLeft(segOne, "0")
+			segTwo = strings.TrimLeft(segTwo, "0")
+			if len(segOne) != len(segTwo) {
+				if len(segOne) > len(segTwo) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if cmpRes := strings.Compare(segOne, segTwo); cmpRes != 0 {
+			return cmpRes
+		}
+		one, two = endOne, endTwo
+	}
+
+	if one >= len(a) && two >= len(b) {
+		return 0
+	}
+	// The remaining letters never beat an empty string: '1.0a' < '1.0' but '1.0' < '1.0.1' and '1.5' < '1.5.a'.
+	if (one >= len(a) && !isAlpha(b[two])) || (one < len(a) && isAlpha(a[one])) {
+		return -1
+	}
+	return 1
+}
+
+// splitEVR splits '[epoch:]version[-release]', the epoch is '0' if not set and the release may be empty.
+func splitEVR(evr string) (string, string, string) {
+	epoch := "0"
+	idx := 0
+	for idx < len(evr) && isDigit(evr[idx]) {
+		idx++
+	}
+	rest := evr
+	if idx < len(evr) && evr[idx] == ':' {
+		if idx > 0 {
+			epoch = evr[:idx]
+		}
+		rest = evr[idx+1:]
+	}
+	if last := strings.LastIndex(rest, "-"); last >= 0 {
+		return epoch, rest[:last], rest[last+1:]
+	}
+	return epoch, rest, ""
+}
+
+// vercmp compares package versions the way pacman does, it returns -1, 0 or 1.
+// Releases are compared only if both versions have them, so '1.0' equals '1.0-2'.
+func vercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	epochA, versionA, releaseA := splitEVR(a)
+	epochB, versionB, releaseB := splitEVR(b)
+	if result := rpmvercmp(epochA, epochB); result != 0 {
+		return result
+	}
+	if result := rpmvercmp(versionA, versionB); result != 0 {
+		return result
+	}
+	if releaseA != "" && releaseB != "" {
+		return rpmvercmp(releaseA, releaseB)
+	}
+	return 0
+}
+
+type depMod int
+
+const (
+	depAny depMod = iota
+	depEq
+	depGe
+	depLe
+	depGt
+	depLt
+)
+
+// depOperators are ordered so that two-character operators are matched first.
+var depOperators = []struct {
+	op  string
+	mod depMod
+}{
+	{">=", depGe},
+	{"<=", depLe},
+	{"=", depEq},
+	{">", depGt},
+	{"<", depLt},
+}
+
+// pkgDep is a dependency like 'glibc>=2.39', the version is empty for any version.
+type pkgDep struct {
+	name    string
+	mod     depMod
+	version string
+}
+
+// parseDep parses the dependency of '%DEPENDS%' and similar fields, the optdepends description is dropped.
+func parseDep(raw string) pkgDep {
+	raw, _, _ = strings.Cut(raw, ": ")
+	raw = strings.TrimSpace(raw)
+	for idx := 0; idx < len(raw); idx++ {
+		for _, operator := range depOperators {
+			if strings.HasPrefix(raw[idx:], operator.op) {
+				return pkgDep{name: raw[:idx], mod: operator.mod, version: raw[idx+len(operator.op):]}
+			}
+		}
+	}
+	return pkgDep{name: raw, mod: depAny}
+}
+
+func (d pkgDep) String() string {
+	for _, operator := range depOperators {
+		if operator.mod == d.mod {
+			return fmt.Sprintf("%s%s%s", d.name, operator.op, d.version)
+		}
+	}
+	return d.name
+}
+
+// isVersionOk tells whether the version meets the constraint of the dependency.
+func (d pkgDep) isVersionOk(version string) bool {
+	if d.mod == depAny {
+		return true
+	}
+	result := vercmp(version, d.version)
+	switch d.mod {
+	case depEq:
+		return result == 0
+	case depGe:
+		return result >= 0
+	case depLe:
+		return result <= 0
+	case depGt:
+		return result > 0
+	case depLt:
+		return result < 0
+	default:
+		return false
+	}
+}
+
+// isSatisfiedBy tells whether the package meets the dependency by itself or by one of its provides,
+// a provide without a version meets only dependencies without a version.
+func (d pkgDep) isSatisfiedBy(desc *pkgDesc) bool {
+	if desc.name == d.name && d.isVersionOk(desc.version) {
+		return true
+	}
+	for _, raw := range desc.provides {
+		provide := parseDep(raw)
+		if provide.name != d.name {
+			continue
+		}
+		if d.mod == depAny || (provide.mod == depEq && d.isVersionOk(provide.version)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package main
+
+import "testing"
+
+// The cases come from pacman's test/util/vercmptest.sh, plus the ones of real world versions.
+var vercmpCases = []struct {
+	one  string
+	two  string
+	want int
+}{
+	// All similar length, no pkgrel.
+	{"1.5.0", "1.5.0", 0},
+	{"1.5.1", "1.5.0", 1},
+	// Mixed length.
+	{"1.5.1", "1.5", 1},
+	// With pkgrel, simple.
+	{"1.5.0-1", "1.5.0-1", 0},
+	{"1.5.0-1", "1.5.0-2", -1},
+	{"1.5.0-1", "1.5.1-1", -1},
+	{"1.5.0-2", "1.5.1-1", -1},
+	// With pkgrel, mixed lengths.
+	{"1.5-1", "1.5.1-1", -1},
+	{"1.5-2", "1.5.1-1", -1},
+	{"1.5-2", "1.5.1-2", -1},
+	// Mixed pkgrel inclusion.
+	{"1.5", "1.5-1", 0},
+	{"1.5-1", "1.5", 0},
+	{"1.1-1", "1.1", 0},
+	{"1.0-1", "1.1", -1},
+	{"1.1-1", "1.0", 1},
+	// Alphanumeric versions.
+	{"1.5b-1", "1.5-1", -1},
+	{"1.5b", "1.5", -1},
+	{"1.5b-1", "1.5", -1},
+	{"1.5b", "1.5.1", -1},
+	// From the manpage.
+	{"1.0a", "1.0alpha", -1},
+	{"1.0alpha", "1.0b", -1},
+	{"1.0b", "1.0beta", -1},
+	{"1.0beta", "1.0rc", -1},
+	{"1.0rc", "1.0", -1},
+	// Alpha-dotted versions.
+	{"1.5.a", "1.5", 1},
+	{"1.5.b", "1.5.a", 1},
+	{"1.5.1", "1.5.b", 1},
+	// Alpha dots and dashes.
+	{"1.5.b-1", "1.5.b", 0},
+	{"1.5-1", "1.5.b", -1},
+	// Same or similar content, differing separators.
+	{"2.0", "2_0", 0},
+	{"2.0_a", "2_0.a", 0},
+	{"2.0a", "2.0.a", -1},
+	{"2___a", "2_a", 1},
+	// Epoch included version comparisons.
+	{"0:1.0", "0:1.0", 0},
+	{"0:1.0", "0:1.1", -1},
+	{"1:1.0", "0:1.0", 1},
+	{"1:1.0", "0:1.1", 1},
+	{"1:1.0", "2:1.1", -1},
+	// Epoch and sometimes present pkgrel.
+	{"1:1.0", "0:1.0-1", 1},
+	{"1:1.0-1", "0:1.1-1", 1},
+	// Epoch included on one version.
+	{"0:1.0", "1.0", 0},
+	{"0:1.0", "1.1", -1},
+	{"0:1.1", "1.0", 1},
+	{"1:1.0", "1.0", 1},
+	{"1:1.0", "1.1", 1},
+	{"1:1.1", "1.1", 1},
+	// Trailing parts of VCS and point releases.
+	{"1.0", "1.0.r12.gabc", -1},
+	{"2.38", "2.38+r5+g1234", -1},
+	{"1.0", "1.0_a", -1},
+	{"1.0", "1.0.", -1},
+	{"1.0.r12.gabc-1", "1.0.r13.g123-1", -1},
+	// Leading zeroes and long numbers.
+	{"1.001", "1.1", 0},
+	{"2.0.0", "10.0", -1},
+	{"20261018", "20260918", 1},
+}
+
+func TestVercmp(t *testing.T) {
+	for _, tc := range vercmpCases {
+		if got := vercmp(tc.one, tc.two); got != tc.want {
+			t.Errorf("vercmp(%q, %q) = %d, want %d", tc.one, tc.two, got, tc.want)
+		}
+		// The order must not depend on the side the version is on.
+		if got := vercmp(tc.two, tc.one); got != -tc.want {
+			t.Errorf("vercmp(%q, %q) = %d, want %d", tc.two, tc.one, got, -tc.want)
+		}
+	}
+}
+
+func TestParseDep(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want pkgDep
+	}{
+		{"glibc", pkgDep{name: "glibc", mod: depAny}},
+		{"glibc>=2.39-1", pkgDep{name: "glibc", mod: depGe, version: "2.39-1"}},
+		{"glibc<=2.39", pkgDep{name: "glibc", mod: depLe, version: "2.39"}},
+		{"glibc=1:2.39", pkgDep{name: "glibc", mod: depEq, version: "1:2.39"}},
+		{"glibc>2", pkgDep{name: "glibc", mod: depGt, version: "2"}},
+		{"glibc<3", pkgDep{name: "glibc", mod: depLt, version: "3"}},
+		{"python-foo: for the foo support", pkgDep{name: "python-foo", mod: depAny}},
+		{"python-foo>=1.0: for the foo support", pkgDep{name: "python-foo", mod: depGe, version: "1.0"}},
+	}
+	for _, tc := range cases {
+		got := parseDep(tc.raw)
+		if got != tc.want {
+			t.Errorf("parseDep(%q) = %+v, want %+v", tc.raw, got, tc.want)
+		}
+	}
+	for _, raw := range []string{"glibc", "glibc>=2.39-1", "glibc<=2.39", "glibc=1:2.39", "glibc>2", "glibc<3"} {
+		if got := parseDep(raw).String(); got != raw {
+			t.Errorf("parseDep(%q).String() = %q", raw, got)
+		}
+	}
+}
+
+func TestIsSatisfiedBy(t *testing.T) {
+	desc := &pkgDesc{name: "bash", version: "5.2.037-1", provides: []string{"sh", "libreadline.so=8-64"}}
+	cases := []struct {
+		dep  string
+		want bool
+	}{
+		{"bash", true},
+		{"bash>=5.2", true},
+		{"bash>=5.2.037-2", false},
+		{"bash=5.2.037", true},
+		{"bash<5.2", false},
+		{"bash>5.1", true},
+		{"bash<=5.2.037-1", true},
+		{"sh", true},
+		{"sh>=1", false},
+		{"libreadline.so", true},
+		{"libreadline.so=8-64", true},
+		{"libreadline.so>=9", false},
+		{"zsh", false},
+	}
+	for _, tc := range cases {
+		if got := parseDep(tc.dep).isSatisfiedBy(desc); got != tc.want {
+			t.Errorf("%q satisfied by %s %s: %t, want %t", tc.dep, desc.name, desc.version, got, tc.want)
+		}
+	}
+}